@@ -22,17 +22,50 @@ package cmd
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func init() {
 	rootCmd.AddCommand(pingCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(addCmd)
+	rootCmd.AddCommand(shortenCmd)
 	rootCmd.AddCommand(removeCmd)
+	rootCmd.AddCommand(hostCmd)
+	rootCmd.AddCommand(statsCmd)
 
 	removeCmd.Flags().BoolP("force", "f", false, "Forces deletion of all redirects for a hostname")
+	addCmd.Flags().IntP("code", "c", 0, "HTTP status code of the redirect: 301, 302, 303, 307 or 308 (0 uses the server default 307)")
+	addCmd.Flags().BoolP("permanent", "p", false, "Permanent redirect, same as --code 301")
+	addCmd.Flags().Bool("prefix", false, "Redirect all URLs starting with url, the rest of the path is appended to target (same as url ending with *)")
+	addCmd.Flags().Int("priority", 0, "Priority of a regular expression rule, rules with higher priority are matched first")
+	addCmd.Flags().StringP("query", "q", "", "Query policy: drop, pass, merge or override (empty uses the policy of the hostname)")
+	addCmd.Flags().String("valid-from", "", "Time from which the redirect is used, e.g. 2018-06-01T12:00:00Z or \"2018-06-01 12:00\" (local time)")
+	addCmd.Flags().String("valid-until", "", "Time until which the redirect is used, e.g. 2018-06-30T12:00:00Z or \"2018-06-30 12:00\" (local time)")
+	addCmd.Flags().StringArray("schedule", nil, "Change of the target at a time as time=target, e.g. \"2018-06-15 00:00=https://example.com/sale\" (can be repeated)")
+	shortenCmd.Flags().String("host", "", "Hostname of the short URL (can also be set as shorten-host in the config file)")
+	shortenCmd.Flags().StringP("short", "s", "", "Custom short code instead of a generated one (letters, digits, - and _)")
+	shortenCmd.Flags().IntP("code", "c", 0, "HTTP status code of the redirect: 301, 302, 303, 307 or 308 (0 uses the server default 307)")
+	shortenCmd.Flags().BoolP("permanent", "p", false, "Permanent redirect, same as --code 301")
+	viper.BindPFlag("shorten-host", shortenCmd.Flags().Lookup("host"))
+	statsCmd.Flags().IntP("top", "n", 0, "Show only the redirects with most hits (0 shows all)")
+	statsCmd.Flags().String("from", "", "Count only hits from this day on, e.g. 2018-06-01 (UTC)")
+	statsCmd.Flags().String("to", "", "Count only hits until this day, e.g. 2018-06-30 (UTC)")
+	hostCmd.Flags().StringP("query", "q", "", "Query policy for all redirects of the hostname without own policy: drop, pass, merge or override")
+	hostCmd.Flags().StringP("default", "d", "", "Default target for all URLs of the hostname without redirect (empty removes it)")
+	hostCmd.Flags().Int("default-code", 0, "HTTP status code of the default target: 301, 302, 303, 307 or 308 (0 uses the server default 307)")
+	hostCmd.Flags().Bool("ignore-case", false, "Match paths of the hostname case-insensitive (--ignore-case=false disables it)")
+	hostCmd.Flags().Bool("trailing-slash", false, "Match URLs of the hostname with and without trailing slash (--trailing-slash=false disables it)")
+	hostCmd.Flags().Bool("https", false, "Redirect plain HTTP requests for the hostname to HTTPS before any redirect (--https=false disables it)")
+	hostCmd.Flags().Int("hsts-max-age", 0, "Send a Strict-Transport-Security header with this max-age in seconds on HTTPS responses (0 disables it)")
+	hostCmd.Flags().Bool("hsts-include-subdomains", false, "Add includeSubDomains to the Strict-Transport-Security header")
+	hostCmd.Flags().Bool("hsts-preload", false, "Add preload to the Strict-Transport-Security header (requires --hsts-include-subdomains and a max-age of a year)")
 }
 
 var pingCmd = &cobra.Command{
@@ -68,10 +101,153 @@ var addCmd = &cobra.Command{
 	Use:     "add hostname url target",
 	Aliases: []string{"insert", "change"},
 	Short:   "adds a new or changes an existing redirect",
-	Example: "add www.example.com / http://www.google.com",
-	Args:    cobra.ExactArgs(3),
+	Long: `add creates or changes the redirect for a hostname and url.
+
+	The url can be a prefix rule ending with *, e.g. /docs/* redirects /docs/a/b to target + "a/b".
+	The url can be a regular expression starting with ~, which is matched against path and query,
+	e.g. ~^/user/(\d+)$ with target https://example.com/profile?id=$1 redirects /user/42 to .../profile?id=42.
+	The url can contain a query, e.g. /search?lang=en matches /search?lang=en&q=go but not /search?q=go.
+	For the same hostname an exact url with query wins over the url without query, an exact url wins over
+	regular expressions, regular expressions win over prefix rules, and longer prefixes win over shorter ones.
+
+	The query policy defines what happens with the query of a request:
+	  drop       the query is discarded (default)
+	  pass       the query is appended to the target as is
+	  merge      the parameters are merged into the query of the target, parameters of the target win
+	  override   the parameters are merged into the query of the target, parameters of the request win
+
+	With --valid-from and --valid-until the redirect is only used within this period, expired redirects
+	are removed by the server after a grace period. With --schedule the target changes at the given times.
+	`,
+	Example: `add www.example.com / http://www.google.com --permanent
+add old.example.com /docs/ https://new.example.com/docs/ --prefix
+add www.example.com '~^/user/(\d+)$' 'https://example.com/profile?id=$1' --priority 10
+add www.example.com /summer https://example.com/sale --valid-from "2018-06-01 00:00" --valid-until "2018-09-01 00:00"`,
+	Args: cobra.ExactArgs(3),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return requestFromServer("add", args)
+		code, err := cmd.Flags().GetInt("code")
+		if err != nil {
+			return err
+		}
+		permanent, err := cmd.Flags().GetBool("permanent")
+		if err != nil {
+			return err
+		}
+		if permanent {
+			if code != 0 && code != http.StatusMovedPermanently {
+				return fmt.Errorf("--permanent and --code %v cannot be combined", code)
+			}
+			code = http.StatusMovedPermanently
+		}
+
+		prefix, err := cmd.Flags().GetBool("prefix")
+		if err != nil {
+			return err
+		}
+		if prefix && !strings.HasSuffix(args[1], "*") {
+			args[1] += "*"
+		}
+
+		priority, err := cmd.Flags().GetInt("priority")
+		if err != nil {
+			return err
+		}
+
+		var extra []parameter
+		if code != 0 {
+			extra = append(extra, parameter{"code", strconv.Itoa(code)})
+		}
+		if priority != 0 {
+			extra = append(extra, parameter{"priority", strconv.Itoa(priority)})
+		}
+
+		query, err := cmd.Flags().GetString("query")
+		if err != nil {
+			return err
+		}
+		if query != "" {
+			extra = append(extra, parameter{"query", query})
+		}
+
+		for _, flag := range []struct{ name, param string }{{"valid-from", "validFrom"}, {"valid-until", "validUntil"}} {
+			value, err := cmd.Flags().GetString(flag.name)
+			if err != nil {
+				return err
+			}
+			if value == "" {
+				continue
+			}
+			t, err := parseTime(value)
+			if err != nil {
+				return fmt.Errorf("invalid --%v: %v", flag.name, err)
+			}
+			extra = append(extra, parameter{flag.param, t.Format(time.RFC3339)})
+		}
+
+		schedule, err := cmd.Flags().GetStringArray("schedule")
+		if err != nil {
+			return err
+		}
+		for _, change := range schedule {
+			i := strings.IndexByte(change, '=')
+			if i < 0 {
+				return fmt.Errorf("invalid --schedule %v, expected time=target", change)
+			}
+			t, err := parseTime(change[:i])
+			if err != nil {
+				return fmt.Errorf("invalid --schedule %v: %v", change, err)
+			}
+			extra = append(extra, parameter{"schedule", t.Format(time.RFC3339) + "=" + change[i+1:]})
+		}
+		return requestFromServer("add", args, extra...)
+	},
+}
+
+var shortenCmd = &cobra.Command{
+	Use:   "shorten url",
+	Short: "creates a short URL for a target",
+	Long: `shorten creates a redirect with a short code on a hostname, e.g. https://example.com/k3Hx9a, for url.
+
+	Without --short the server generates a free code. If the hostname already has a short URL for the same
+	url and status code, this short URL is returned instead of creating another one.
+	Some codes are reserved by the server (see --short-reserved of the server).
+	`,
+	Example: `shorten https://example.com/blog/2018/06/a-long-title --host go.example.com
+shorten https://example.com/summer-sale --host go.example.com --short sale --permanent`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		host := viper.GetString("shorten-host")
+		if host == "" {
+			return fmt.Errorf("hostname is required (--host or shorten-host in the config file)")
+		}
+
+		code, err := cmd.Flags().GetInt("code")
+		if err != nil {
+			return err
+		}
+		permanent, err := cmd.Flags().GetBool("permanent")
+		if err != nil {
+			return err
+		}
+		if permanent {
+			if code != 0 && code != http.StatusMovedPermanently {
+				return fmt.Errorf("--permanent and --code %v cannot be combined", code)
+			}
+			code = http.StatusMovedPermanently
+		}
+
+		extra := []parameter{{"target", args[0]}}
+		if code != 0 {
+			extra = append(extra, parameter{"code", strconv.Itoa(code)})
+		}
+		short, err := cmd.Flags().GetString("short")
+		if err != nil {
+			return err
+		}
+		if short != "" {
+			extra = append(extra, parameter{"short", short})
+		}
+		return requestFromServer("shorten", []string{host}, extra...)
 	},
 }
 
@@ -110,3 +286,76 @@ var removeCmd = &cobra.Command{
 		return requestFromServer("delete", args)
 	},
 }
+
+var hostCmd = &cobra.Command{
+	Use:   "host [hostname]",
+	Short: "show or change the settings of a hostname",
+	Long: `host shows the settings which apply to all redirects of a hostname.
+
+	The command allows three forms
+	  host                              Lists the settings of all hostnames with settings
+	  host hostname                     Shows the settings of a hostname
+	  host hostname --query policy      Changes the query policy of a hostname (--query "" resets it)
+	  host hostname --default target    Changes the default target of a hostname (--default "" removes it)
+
+	  host hostname --ignore-case       Matches paths of a hostname case-insensitive
+	  host hostname --trailing-slash    Matches URLs of a hostname with and without trailing slash
+	  host hostname --https             Redirects plain HTTP requests of a hostname to HTTPS
+	  host hostname --hsts-max-age n    Sends a Strict-Transport-Security header on HTTPS responses of a hostname
+
+	The default target is used for all URLs of the hostname without redirect, the hostname * applies to all hostnames.
+	Settings which are not given are not changed.
+	`,
+	Example: `host www.example.com --query pass
+host old.example.com --default https://new.example.com/ --default-code 301
+host www.example.com --https --hsts-max-age 31536000 --hsts-include-subdomains`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var extra []parameter
+		for flag, param := range map[string]string{
+			"query": "query", "default": "default", "default-code": "defaultCode",
+			"ignore-case": "ignoreCase", "trailing-slash": "trailingSlash",
+			"https": "https", "hsts-max-age": "hstsMaxAge", "hsts-include-subdomains": "hstsIncludeSubDomains", "hsts-preload": "hstsPreload",
+		} {
+			if cmd.Flags().Changed(flag) {
+				extra = append(extra, parameter{param, cmd.Flags().Lookup(flag).Value.String()})
+			}
+		}
+
+		if len(extra) == 0 {
+			return requestFromServer("hosts", args)
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("hostname is required to change settings")
+		}
+		return requestFromServer("setHost", args, extra...)
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:     "stats [hostname] [url]",
+	Aliases: []string{"hits"},
+	Short:   "show the hit counters of redirects",
+	Long: `stats shows how often redirects were used, most hits first.
+
+	The command allows three forms
+	  stats                  Shows the hit counters of all redirects
+	  stats hostname         Shows the hit counters of all redirects of a hostname
+	  stats hostname url     Shows the hit counter of a specific redirect (the url of a rule, e.g. /docs/*)
+
+	Hits of a default target have no url, hits of the fallback target have no hostname and url.
+	`,
+	Example: `stats --top 10
+stats www.example.com --from 2018-06-01 --to 2018-06-30`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var extra []parameter
+		for _, flag := range []string{"top", "from", "to"} {
+			value := cmd.Flags().Lookup(flag).Value.String()
+			if value != "" && value != "0" {
+				extra = append(extra, parameter{flag, value})
+			}
+		}
+		return requestFromServer("stats", args, extra...)
+	},
+}
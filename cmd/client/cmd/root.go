@@ -13,6 +13,7 @@ import (
 var (
 	cfgFile string
 	server  string
+	token   string
 )
 var build = "development"
 
@@ -37,8 +38,10 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.client.yaml)")
-	rootCmd.PersistentFlags().StringVar(&server, "server", "localhost:8080", "address of admin interface")
+	rootCmd.PersistentFlags().StringVar(&server, "server", "localhost:8080", "address of admin interface (host:port or unix:/path/to/socket)")
 	viper.BindPFlag("server", rootCmd.PersistentFlags().Lookup("server"))
+	rootCmd.PersistentFlags().StringVar(&token, "token", "", "API key for the admin interface (created with 'server keys add'), can also be set as token in the config file")
+	viper.BindPFlag("token", rootCmd.PersistentFlags().Lookup("token"))
 }
 
 // initConfig reads in config file and ENV variables if set.
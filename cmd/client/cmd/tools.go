@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -13,12 +18,43 @@ type redirect struct {
 	Hostname string //hostname of the redirector
 	URL      string //URL on the hostname
 	Target   string //target address
+	Code     int    //HTTP status code, 0 for server default
+	Query    string //query policy, empty for the policy of the hostname
+
+	ValidFrom  *time.Time //the redirect is used from this time on
+	ValidUntil *time.Time //the redirect is used until this time
+	Schedule   []struct {
+		From   time.Time //time from which Target is used
+		Target string    //target address from From on
+	}
+}
+
+type hostSettings struct {
+	Hostname              string //hostname of the redirector
+	Query                 string //query policy, empty for drop
+	Default               string //target for URLs without redirect
+	DefaultCode           int    //HTTP status code of the default target, 0 for server default
+	IgnoreCase            bool   //paths are matched case-insensitive
+	TrailingSlash         bool   //URLs are matched with and without trailing slash
+	HTTPS                 bool   //plain HTTP requests are upgraded to HTTPS
+	HSTSMaxAge            int    //max-age of the Strict-Transport-Security header, 0 for none
+	HSTSIncludeSubDomains bool   //Strict-Transport-Security header includes subdomains
+	HSTSPreload           bool   //Strict-Transport-Security header allows preloading
+}
+
+type hitCount struct {
+	Hostname string
+	URL      string
+	Total    int64     //number of hits
+	LastHit  time.Time //time of the last hit
 }
 
 type response struct {
 	Status  bool
 	Message string
 	Content []redirect
+	Hosts   []hostSettings
+	Stats   []hitCount
 }
 
 type parameter struct {
@@ -46,15 +82,32 @@ func createParamsFromArgs(args []string) []parameter {
 	return params
 }
 
-func requestFromServer(function string, args []string) error {
+// httpClient returns the client and the hostname for requests to server (host:port or unix:/path/to/socket)
+func httpClient(server string) (*http.Client, string) {
+	if !strings.HasPrefix(server, "unix:") {
+		return http.DefaultClient, server
+	}
+
+	socket := strings.TrimPrefix(server, "unix:")
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}, "localhost"
+}
+
+// requestFromServer calls function on the server, args are passed as host, url and target, extra contains further parameters
+func requestFromServer(function string, args []string, extra ...parameter) error {
 	server := viper.GetString("server")
+	client, host := httpClient(server)
 
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%v/redirects/%v", server, function), nil)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%v/redirects/%v", host, function), nil)
 	if err != nil {
 		return fmt.Errorf("could not build request: %v", err)
 	}
 
-	params := createParamsFromArgs(args)
+	params := append(createParamsFromArgs(args), extra...)
 	if params != nil {
 		q := req.URL.Query()
 		for _, param := range params {
@@ -62,8 +115,11 @@ func requestFromServer(function string, args []string) error {
 		}
 		req.URL.RawQuery = q.Encode()
 	}
+	if token := viper.GetString("token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Printf("Request to %v could not be sent \n\n", server)
 		os.Exit(1)
@@ -92,12 +148,90 @@ func processResponse(response *response) error {
 	fmt.Printf("Operation successful (%v) \n\n", response.Message)
 
 	if len(response.Content) > 0 {
-		fmt.Printf("%-30s %-10s %-50s \n", "Hostname", "URL", "Target")
-		fmt.Printf("%-30s %-10s %-50s \n", "--------", "---", "------")
+		fmt.Printf("%-30s %-10s %-50s %-4s %-8s %-s \n", "Hostname", "URL", "Target", "Code", "Query", "Valid")
+		fmt.Printf("%-30s %-10s %-50s %-4s %-8s %-s \n", "--------", "---", "------", "----", "-----", "-----")
 		for _, r := range response.Content {
-			fmt.Printf("%-30s %-10s %-50s \n", r.Hostname, r.URL, r.Target)
+			code := "-"
+			if r.Code != 0 {
+				code = strconv.Itoa(r.Code)
+			}
+			valid := "-"
+			if r.ValidFrom != nil || r.ValidUntil != nil {
+				valid = formatTime(r.ValidFrom) + " - " + formatTime(r.ValidUntil)
+			}
+			fmt.Printf("%-30s %-10s %-50s %-4s %-8s %-s \n", r.Hostname, r.URL, r.Target, code, orDash(r.Query), valid)
+			for _, change := range r.Schedule {
+				fmt.Printf("%-30s %-10s %-50s from %v \n", "", "", change.Target, formatTime(&change.From))
+			}
+		}
+		fmt.Println()
+	}
+
+	if len(response.Hosts) > 0 {
+		fmt.Printf("%-30s %-8s %-50s %-4s %-30s %-s \n", "Hostname", "Query", "Default", "Code", "Matching", "HTTPS")
+		fmt.Printf("%-30s %-8s %-50s %-4s %-30s %-s \n", "--------", "-----", "-------", "----", "--------", "-----")
+		for _, h := range response.Hosts {
+			code := "-"
+			if h.DefaultCode != 0 {
+				code = strconv.Itoa(h.DefaultCode)
+			}
+			var matching []string
+			if h.IgnoreCase {
+				matching = append(matching, "ignore-case")
+			}
+			if h.TrailingSlash {
+				matching = append(matching, "trailing-slash")
+			}
+			var https []string
+			if h.HTTPS {
+				https = append(https, "upgrade")
+			}
+			if h.HSTSMaxAge > 0 {
+				https = append(https, "hsts="+strconv.Itoa(h.HSTSMaxAge))
+			}
+			if h.HSTSIncludeSubDomains {
+				https = append(https, "include-subdomains")
+			}
+			if h.HSTSPreload {
+				https = append(https, "preload")
+			}
+			fmt.Printf("%-30s %-8s %-50s %-4s %-30s %-s \n", h.Hostname, orDash(h.Query), orDash(h.Default), code,
+				orDash(strings.Join(matching, ",")), orDash(strings.Join(https, ",")))
+		}
+		fmt.Println()
+	}
+
+	if len(response.Stats) > 0 {
+		fmt.Printf("%-30s %-30s %10s %-16s \n", "Hostname", "URL", "Hits", "Last hit")
+		fmt.Printf("%-30s %-30s %10s %-16s \n", "--------", "---", "----", "--------")
+		for _, s := range response.Stats {
+			fmt.Printf("%-30s %-30s %10d %-16s \n", orDash(s.Hostname), orDash(s.URL), s.Total, formatTime(&s.LastHit))
 		}
 		fmt.Println()
 	}
 	return nil
 }
+
+// parseTime parses a time in RFC 3339 format or as "2006-01-02 15:04" in local time
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+}
+
+// formatTime returns t in local time, "" if t is nil
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// orDash returns s or "-" if s is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
+	redirect "github.com/flo80/redirect/pkg/redirect"
+	storage "github.com/flo80/redirect/pkg/storage"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -24,13 +27,40 @@ To run in this setup, an initial 'redirects.json' is required. To generate one,
 	Version: Build,
 	Run: func(cmd *cobra.Command, args []string) {
 		config.adminAddress = viper.GetString("api")
+		config.adminListenAddress = viper.GetString("api-listen")
+		config.adminTimeout = viper.GetDuration("api-timeout")
 		config.debug = viper.GetBool("debug")
 		config.listenAddress = viper.GetString("listen")
 		config.redirectFile = viper.GetString("storage")
+		config.journalFile = viper.GetString("journal")
 		config.redirectFileIgnoreErr = viper.GetBool("force")
 		config.redirectNoSave = viper.GetBool("volatile")
+		config.redirectBackups = viper.GetInt("backups")
+		config.autosaveInterval = viper.GetDuration("autosave")
+		config.watchInterval = viper.GetDuration("watch")
+		config.shutdownTimeout = viper.GetDuration("shutdown-timeout")
+		config.accessLogFile = viper.GetString("access-log")
+		config.accessLogFormat = viper.GetString("access-log-format")
+		config.statsFile = viper.GetString("stats")
+		config.statsInterval = viper.GetDuration("stats-interval")
+		config.sweepInterval = viper.GetDuration("sweep")
+		config.sweepGrace = viper.GetDuration("sweep-grace")
+		config.fallback = viper.GetString("fallback")
+		config.fallbackCode = viper.GetInt("fallback-code")
+		config.keysFile = viper.GetString("keys")
+		config.adminInsecure = viper.GetBool("api-insecure")
+		config.tlsListenAddress = viper.GetString("tls-listen")
+		config.tlsCertDir = viper.GetString("tls-certs")
+		config.tlsSelfSigned = viper.GetBool("tls-self-signed")
+		config.trustedProxies = viper.GetStringSlice("trusted-proxies")
+		config.shortAlphabet = viper.GetString("short-alphabet")
+		config.shortLength = viper.GetInt("short-length")
+		config.shortReserved = viper.GetStringSlice("short-reserved")
 
-		runServer()
+		if err := runServer(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -49,9 +79,34 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.server.yaml)")
 	rootCmd.PersistentFlags().StringVarP(&config.listenAddress, "listen", "l", ":8080", "Sets listen address (ip:port) for redirector; empty ip for all interfaces")
 	rootCmd.PersistentFlags().StringVarP(&config.adminAddress, "api", "a", "", "Enable HTTP API on a specific hostname (listen address has to cover this hostname)")
+	rootCmd.PersistentFlags().StringVar(&config.adminListenAddress, "api-listen", "", "Serve the HTTP API on its own address (ip:port or unix:/path/to/socket) instead of a hostname of the listen address, e.g. 127.0.0.1:9090")
+	rootCmd.PersistentFlags().DurationVar(&config.adminTimeout, "api-timeout", 30*time.Second, "Read and write timeout of the HTTP API with --api-listen (0 for no limit)")
 	rootCmd.PersistentFlags().StringVarP(&config.redirectFile, "storage", "s", "redirects.json", "Save file for the redirector (loaded at start of server, saved at closing of server)")
+	rootCmd.PersistentFlags().StringVarP(&config.journalFile, "journal", "j", "", "Journal file for all changes, the save file is used as snapshot of the journal (changes are persisted immediately, --force and --volatile are ignored)")
 	rootCmd.PersistentFlags().BoolVarP(&config.redirectFileIgnoreErr, "force", "f", false, "Ignore load errors when opening redirector save file (starts with empty redirector), this can be useful for first setup of server")
 	rootCmd.PersistentFlags().BoolVar(&config.redirectNoSave, "volatile", false, "Do not save redirects when closing server")
+	rootCmd.PersistentFlags().IntVar(&config.redirectBackups, "backups", 5, "Number of timestamped backups of the save file kept next to it (0 disables backups)")
+	rootCmd.PersistentFlags().DurationVar(&config.autosaveInterval, "autosave", 0, "Interval to save redirects while the server is running, e.g. 5m (0 only saves when closing server)")
+	rootCmd.PersistentFlags().DurationVar(&config.watchInterval, "watch", 0, "Interval to check the save file for changes and reload it, e.g. 10s (0 disables watching, reload is also triggered by SIGHUP; ignored with --journal)")
+	rootCmd.PersistentFlags().DurationVar(&config.shutdownTimeout, "shutdown-timeout", 10*time.Second, "Maximum time to wait for requests in progress when stopping the server (redirects are saved afterwards)")
+	rootCmd.PersistentFlags().StringVar(&config.accessLogFile, "access-log", "", "File for the access log of redirect requests, - for stdout (reopened on SIGUSR1, empty logs requests to the server log)")
+	rootCmd.PersistentFlags().StringVar(&config.accessLogFormat, "access-log-format", redirect.AccessLogCombined, "Format of the access log: combined (Combined Log Format) or json")
+	rootCmd.PersistentFlags().StringVar(&config.statsFile, "stats", "", "File for the hit counters of all redirects (default is the save file with suffix .stats, none with --volatile)")
+	rootCmd.PersistentFlags().DurationVar(&config.statsInterval, "stats-interval", time.Minute, "Interval to save the hit counters and drop the counters of removed redirects while the server is running (0 only saves when closing server)")
+	rootCmd.PersistentFlags().DurationVar(&config.sweepInterval, "sweep", 0, "Interval to remove expired redirects, each removed redirect is logged (0 keeps expired redirects)")
+	rootCmd.PersistentFlags().DurationVar(&config.sweepGrace, "sweep-grace", 24*time.Hour, "Time expired redirects are kept before they are removed")
+	rootCmd.PersistentFlags().StringVar(&config.fallback, "fallback", "", "Target for all requests without redirect or default target of the hostname (empty replies 404 Not Found)")
+	rootCmd.PersistentFlags().IntVar(&config.fallbackCode, "fallback-code", 0, "HTTP status code of the fallback redirect: 301, 302, 303, 307 or 308 (0 for 307)")
+	rootCmd.PersistentFlags().StringVar(&config.keysFile, "keys", "", "File with the API keys for the admin API (default is the save file with suffix .keys; it has to exist if the admin API is enabled)")
+	rootCmd.PersistentFlags().BoolVar(&config.adminInsecure, "api-insecure", false, "Serve the admin API without API keys, anyone reaching it can change redirects (only for development)")
+	rootCmd.PersistentFlags().StringVar(&config.tlsListenAddress, "tls-listen", "", "Also serve redirects with HTTPS on this address (ip:port), e.g. :443")
+	rootCmd.PersistentFlags().StringVar(&config.tlsCertDir, "tls-certs", "", "Directory of the certificates for HTTPS, one PEM file with chain and key per certificate, default.pem for hostnames without certificate (default is the save file with suffix .certs; reloaded on SIGHUP)")
+	rootCmd.PersistentFlags().BoolVar(&config.tlsSelfSigned, "tls-self-signed", false, "Generate self-signed certificates for hostnames with redirects but without certificate (for development)")
+	rootCmd.PersistentFlags().StringSliceVar(&config.trustedProxies, "trusted-proxies", nil, "Addresses or networks (CIDR) of proxies terminating TLS, their X-Forwarded-Proto header marks HTTPS requests, e.g. 10.0.0.0/8")
+	rootCmd.PersistentFlags().StringVar(&config.shortAlphabet, "short-alphabet", storage.DefaultShortAlphabet, "Characters of generated short codes (letters, digits, - and _)")
+	rootCmd.PersistentFlags().IntVar(&config.shortLength, "short-length", storage.DefaultShortLength, "Length of generated short codes, longer codes are used when no free code is found")
+	rootCmd.PersistentFlags().StringSliceVar(&config.shortReserved, "short-reserved", storage.DefaultReservedCodes, "Short codes which cannot be used (ignoring case), e.g. paths of a website on the same hostname")
+	rootCmd.PersistentFlags().StringSliceVar(&config.targetSchemes, "target-schemes", storage.DefaultTargetSchemes, "URL schemes allowed for redirect targets, e.g. http,https,mailto (paths starting with / are always allowed)")
 	rootCmd.PersistentFlags().BoolVar(&config.debug, "debug", false, "Enable debut output")
 
 	viper.BindPFlags(rootCmd.PersistentFlags())
@@ -82,4 +137,7 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	// used by all commands which load save files
+	config.targetSchemes = viper.GetStringSlice("target-schemes")
 }
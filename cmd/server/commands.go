@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/flo80/redirect/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(validateCmd)
+
+	restoreCmd.Flags().String("backup", "", "Name of the backup to restore (as listed by restore without --backup)")
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore the save file from a backup",
+	Long: `restore lists the backups of the save file or replaces the save file with one of them.
+The current save file is kept as backup as well. 
+
+The server must not be running, as it overwrites the save file when closing.
+
+	  restore                   Lists all backups, newest first
+	  restore --backup name     Restores the backup with this name
+	`,
+	Example: "restore -s redirects.json --backup redirects.json.20180601T120000.000Z.bak",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configFile := viper.GetString("storage")
+		backup, err := cmd.Flags().GetString("backup")
+		if err != nil {
+			return err
+		}
+
+		if backup == "" {
+			backups, err := storage.Backups(configFile)
+			if err != nil {
+				return fmt.Errorf("could not list backups of %v: %v", configFile, err)
+			}
+			if len(backups) == 0 {
+				fmt.Printf("No backups found for %v \n", configFile)
+				return nil
+			}
+			fmt.Printf("Backups of %v (newest first) \n", configFile)
+			for _, b := range backups {
+				fmt.Println(filepath.Base(b))
+			}
+			return nil
+		}
+
+		b, err := storage.ReadBackup(configFile, backup)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(b, newMapRedirector()); err != nil {
+			return fmt.Errorf("backup %v is not a valid save file: %v", backup, err)
+		}
+
+		// the current file is always kept as backup, so a restore can be undone
+		keep := viper.GetInt("backups")
+		if keep < 1 {
+			keep = 1
+		}
+		if err = storage.SaveFile(configFile, b, keep); err != nil {
+			return fmt.Errorf("could not restore %v: %v", configFile, err)
+		}
+		fmt.Printf("Restored %v from backup %v \n", configFile, backup)
+		return nil
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [file...]",
+	Short: "convert save files to the current format version",
+	Long: `migrate rewrites save files of older format versions in place in the current format version.
+Without arguments the save file set with --storage is migrated. The previous file is kept as backup.
+
+The server migrates older files automatically when loading them, they are written in the current version when saved.`,
+	Example: "migrate redirects.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			args = []string{viper.GetString("storage")}
+		}
+
+		for _, configFile := range args {
+			b, err := ioutil.ReadFile(configFile)
+			if err != nil {
+				return fmt.Errorf("could not read %v: %v", configFile, err)
+			}
+
+			_, _, version, err := storage.DecodeFile(b, config.targetSchemes...)
+			if err != nil {
+				return fmt.Errorf("could not parse %v: %v", configFile, err)
+			}
+			if version == storage.FormatVersion {
+				fmt.Printf("%v is already in version %v \n", configFile, version)
+				continue
+			}
+
+			redirector := newMapRedirector()
+			if err = mapRedirectorFromFile(configFile, redirector); err != nil {
+				return err
+			}
+			if err = SaveMapRedirectorToFile(configFile, redirector, viper.GetInt("backups"), nil); err != nil {
+				return err
+			}
+			fmt.Printf("%v migrated from version %v to %v \n", configFile, version, storage.FormatVersion)
+		}
+		return nil
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [file...]",
+	Short: "report invalid redirects and redirect loops of save files",
+	Long: `validate checks all redirects and host settings of save files and lists every problem: targets which are no valid URL
+or use a scheme not allowed by --target-schemes, invalid settings, conflicting URLs of a hostname and redirect loops.
+Without arguments the save file set with --storage is checked (changes of a journal are not included).
+
+The server refuses to load save files with problems, validate shows all of them at once.`,
+	Example:      "validate redirects.json --target-schemes http,https,mailto",
+	SilenceUsage: true, // problems are not usage errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			args = []string{viper.GetString("storage")}
+		}
+
+		problems := 0
+		for _, configFile := range args {
+			b, err := ioutil.ReadFile(configFile)
+			if err != nil {
+				return fmt.Errorf("could not read %v: %v", configFile, err)
+			}
+
+			violations, err := storage.ValidateFile(b, config.targetSchemes...)
+			if err != nil {
+				return fmt.Errorf("could not parse %v: %v", configFile, err)
+			}
+			if len(violations) == 0 {
+				fmt.Printf("%v is valid \n", configFile)
+				continue
+			}
+
+			fmt.Printf("%v has %v problems \n\n", configFile, len(violations))
+			fmt.Printf("%-30s %-30s %-s \n", "Hostname", "URL", "Problem")
+			fmt.Printf("%-30s %-30s %-s \n", "--------", "---", "-------")
+			for _, v := range violations {
+				url := v.URL
+				if url == "" {
+					url = "-"
+				}
+				fmt.Printf("%-30s %-30s %-s \n", v.Hostname, url, v.Reason)
+			}
+			fmt.Println()
+			problems += len(violations)
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("%v problems found", problems)
+		}
+		return nil
+	},
+}
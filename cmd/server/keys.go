@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flo80/redirect/pkg/auth"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysAddCmd)
+	keysCmd.AddCommand(keysRevokeCmd)
+
+	keysAddCmd.Flags().String("name", "", "Description of the key, e.g. its owner")
+	keysAddCmd.Flags().String("scope", auth.ScopeRead, "Permission of the key: read (list redirects, hosts, hit counters and metrics) or write (also change redirects and hosts)")
+	keysAddCmd.Flags().StringArray("host", nil, "Limit the key to a hostname, *.example.com covers all subdomains (can be repeated)")
+}
+
+// keyFile returns the file of the API keys, the save file with suffix .keys if it is not set
+func keyFile() string {
+	if file := viper.GetString("keys"); file != "" {
+		return file
+	}
+	return viper.GetString("storage") + ".keys"
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "manage the API keys of the admin API",
+	Long: `keys lists, adds and revokes the API keys of the admin API.
+Only hashes of the keys are stored in the key file, a key is shown once when it is added.
+A running server uses changes of the key file immediately.
+
+All requests to the admin API (except ping) require a key, the server does not start the admin API
+without key file unless --api-insecure is set:
+	Authorization: Bearer <key>`,
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list all API keys",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys, err := auth.OpenKeyStore(keyFile(), nil)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-10v %-6v %-20v %-30v %v \n", "ID", "SCOPE", "CREATED", "HOSTS", "NAME")
+		for _, key := range keys.Keys() {
+			hosts := strings.Join(key.Hosts, ",")
+			if hosts == "" {
+				hosts = "all"
+			}
+			fmt.Printf("%-10v %-6v %-20v %-30v %v \n", key.ID, key.Scope, key.Created.Format("2006-01-02 15:04:05"), hosts, key.Name)
+		}
+		return nil
+	},
+}
+
+var keysAddCmd = &cobra.Command{
+	Use:     "add",
+	Short:   "add an API key",
+	Example: "keys add --name deploy --scope write --host www.example.com",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		scope, _ := cmd.Flags().GetString("scope")
+		hosts, _ := cmd.Flags().GetStringArray("host")
+
+		keys, err := auth.OpenKeyStore(keyFile(), nil)
+		if err != nil {
+			return err
+		}
+		token, key, err := keys.Add(name, scope, hosts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Added key %v with scope %v to %v \n", key.ID, key.Scope, keyFile())
+		fmt.Printf("The key is only shown once: \n\n%v \n\n", token)
+		return nil
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:     "revoke id",
+	Short:   "revoke an API key",
+	Example: "keys revoke Xy3_a9Kq",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys, err := auth.OpenKeyStore(keyFile(), nil)
+		if err != nil {
+			return err
+		}
+		if err = keys.Revoke(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %v \n", args[0])
+		return nil
+	},
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/flo80/redirect/pkg/auth"
+	"github.com/flo80/redirect/pkg/certs"
+	"github.com/flo80/redirect/pkg/metrics"
 	redirect "github.com/flo80/redirect/pkg/redirect"
 	storage "github.com/flo80/redirect/pkg/storage"
 	log "github.com/sirupsen/logrus"
@@ -16,9 +23,34 @@ var Build = "development"
 var config struct {
 	listenAddress         string
 	adminAddress          string
+	adminListenAddress    string
+	adminTimeout          time.Duration
 	redirectFile          string
+	journalFile           string
 	redirectFileIgnoreErr bool
 	redirectNoSave        bool
+	redirectBackups       int
+	autosaveInterval      time.Duration
+	watchInterval         time.Duration
+	shutdownTimeout       time.Duration
+	accessLogFile         string
+	accessLogFormat       string
+	statsFile             string
+	statsInterval         time.Duration
+	sweepInterval         time.Duration
+	sweepGrace            time.Duration
+	fallback              string
+	fallbackCode          int
+	keysFile              string
+	adminInsecure         bool
+	tlsListenAddress      string
+	tlsCertDir            string
+	tlsSelfSigned         bool
+	trustedProxies        []string
+	shortAlphabet         string
+	shortLength           int
+	shortReserved         []string
+	targetSchemes         []string
 	debug                 bool
 }
 
@@ -26,52 +58,278 @@ func main() {
 	Execute()
 }
 
-func runServer() {
+// runServer starts the server and blocks until it receives SIGINT, SIGTERM or SIGQUIT.
+// On SIGHUP the redirects are reloaded from the storage file (and the certificates from their directory), on SIGUSR1 the access log is reopened.
+// The redirects are always persisted before runServer returns, also if the server could not be started.
+func runServer() (err error) {
 	if config.debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	if err := storage.ValidateCode(config.fallbackCode); err != nil {
+		return fmt.Errorf("invalid fallback code: %v", err)
+	}
+	if config.fallback != "" {
+		if err := storage.ValidateTarget(config.fallback, config.targetSchemes...); err != nil {
+			return fmt.Errorf("invalid fallback: %v", err)
+		}
+	}
 
 	var server *redirect.Server
-	redirector := storage.MapRedirect{}
+	var redirector storage.Redirector
+	var reload func() error // reloads the storage file, nil without storage file
 
-	if config.redirectFile != "" {
-		err := mapRedirectorFromFile(config.redirectFile, &redirector)
-		if err != nil {
-			if !config.redirectFileIgnoreErr {
-				log.Fatalf("Could not create redirector: %v", err)
+	// metrics of the server and of saving files are exported together at /metrics
+	registry := metrics.NewRegistry()
+	saves := storage.NewSaveMetrics(registry)
+
+	if config.journalFile != "" {
+		if config.redirectFile == "" {
+			return fmt.Errorf("journal %v requires a storage file for snapshots", config.journalFile)
+		}
+		journal, journalErr := storage.NewJournalRedirect(config.redirectFile, config.journalFile, 0, config.targetSchemes, nil)
+		if journalErr != nil {
+			return fmt.Errorf("Could not create redirector: %v", journalErr)
+		}
+		defer func() {
+			closeErr := journal.Close()
+			if closeErr != nil {
+				log.Errorf("could not close journal: %v", closeErr)
+				if err == nil {
+					err = closeErr
+				}
+				return
 			}
-			redirector = storage.MapRedirect{}
+			log.Printf("journal %v closed", config.journalFile)
+		}()
+		journal.SetSaveMetrics(saves)
+		redirector = journal
+		reload = func() error {
+			// the storage file is only the snapshot of the last compaction, the journal is replayed on top of it
+			if reloadErr := journal.Reload(); reloadErr != nil {
+				return fmt.Errorf("keeping current redirects, %v", reloadErr)
+			}
+			log.Printf("reloaded %v redirects from %v and journal %v", len(journal.GetAllRedirects()), config.redirectFile, config.journalFile)
+			return nil
 		}
-		if !config.redirectNoSave {
-			defer func() {
-				err := SaveMapRedirectorToFile(config.redirectFile, &redirector)
-				if err != nil {
-					log.Fatalf("could not save redirector to file: %v", err)
+	} else {
+		mapRedirector := newMapRedirector()
+
+		if config.redirectFile != "" {
+			loadErr := mapRedirectorFromFile(config.redirectFile, mapRedirector)
+			if loadErr != nil {
+				if !config.redirectFileIgnoreErr {
+					return fmt.Errorf("Could not create redirector: %v", loadErr)
+				}
+				mapRedirector = newMapRedirector()
+			}
+			reload = func() error {
+				return reloadFromFile(config.redirectFile, func(loaded *storage.MapRedirect) error {
+					mapRedirector.Replace(loaded)
+					return nil
+				})
+			}
+			if config.watchInterval > 0 {
+				stopWatch := watchFile(config.redirectFile, config.watchInterval, reload)
+				defer stopWatch()
+			}
+			if !config.redirectNoSave {
+				defer func() {
+					saveErr := SaveMapRedirectorToFile(config.redirectFile, mapRedirector, config.redirectBackups, saves)
+					if saveErr != nil {
+						log.Errorf("could not save redirector to file: %v", saveErr)
+						if err == nil {
+							err = saveErr
+						}
+						return
+					}
+					log.Printf("redirector configuration file %v saved", config.redirectFile)
+				}()
+
+				if config.autosaveInterval > 0 {
+					// deferred after the final save, so autosave is stopped before
+					stopAutosave := autosave(config.redirectFile, mapRedirector, config.autosaveInterval, config.redirectBackups, saves)
+					defer stopAutosave()
 				}
-				log.Printf("redirector configuration file %v saved", config.redirectFile)
-			}()
+			}
 		}
+		redirector = mapRedirector
 	}
 
-	if config.adminAddress == "" {
-		server = redirect.NewServer(config.listenAddress, redirect.WithRedirector(&redirector))
+	if config.sweepInterval > 0 {
+		// deferred after the final save, so no redirect is removed while saving
+		stopSweep := sweep(redirector, config.sweepInterval, config.sweepGrace)
+		defer stopSweep()
+	}
 
-	} else {
-		server = redirect.NewServer(config.listenAddress, redirect.WithAdmin(config.adminAddress), redirect.WithRedirector(&redirector))
+	stats := &storage.Stats{}
+	statsFile := config.statsFile
+	if statsFile == "" && config.redirectFile != "" && (!config.redirectNoSave || config.journalFile != "") {
+		// with --volatile the hit counters are only kept in a file given explicitly
+		statsFile = config.redirectFile + ".stats"
+	}
+	if statsFile != "" {
+		if loadErr := statsFromFile(statsFile, stats); loadErr != nil {
+			// hit counters are not essential, the server starts anyway
+			log.Errorf("starting with empty hit counters: %v", loadErr)
+		}
+		defer func() {
+			retainStats(stats, redirector)
+			if saveErr := saveStatsToFile(statsFile, stats, saves); saveErr != nil {
+				log.Errorf("could not save hit counters: %v", saveErr)
+				return
+			}
+			log.Printf("hit counters %v saved", statsFile)
+		}()
+	}
+	if config.statsInterval > 0 {
+		// counters of removed redirects are also dropped without stats file
+		stopStats := every(config.statsInterval, func(time.Time) {
+			retainStats(stats, redirector)
+			if statsFile == "" {
+				return
+			}
+			if saveErr := saveStatsToFile(statsFile, stats, saves); saveErr != nil {
+				log.Errorf("could not save hit counters: %v", saveErr)
+			}
+		})
+		defer stopStats()
 	}
 
-	go func() {
-		err := server.StartServer()
+	options := []redirect.Option{redirect.WithRedirector(redirector), redirect.WithStats(stats), redirect.WithTargetSchemes(config.targetSchemes),
+		redirect.WithMetrics(registry)}
+	var accessLog *redirect.AccessLog
+	if config.accessLogFile != "" {
+		accessLog, err = redirect.NewAccessLog(config.accessLogFile, config.accessLogFormat, nil)
 		if err != nil {
-			log.Fatalf("could not start server: %v", err)
+			return err
 		}
+		// deferred calls run in reverse order, so it is closed after the server is shut down;
+		// requests still running after a shutdown timeout are not logged
+		defer accessLog.Close()
+		options = append(options, redirect.WithAccessLog(accessLog))
+	}
+	if config.adminAddress != "" || config.adminListenAddress != "" {
+		if config.adminListenAddress != "" {
+			if config.adminAddress != "" {
+				log.Warnf("admin API is served on %v, hostname %v is not used", config.adminListenAddress, config.adminAddress)
+			}
+			options = append(options, redirect.WithAdminListener(config.adminListenAddress, config.adminTimeout))
+		} else {
+			options = append(options, redirect.WithAdmin(config.adminAddress))
+		}
+
+		if config.adminInsecure {
+			log.Warnf("admin API without authentication (--api-insecure), anyone reaching it can change redirects")
+		} else {
+			// a missing key file is an error, so a mistyped --keys does not open the admin API
+			keysFile := keyFile()
+			if _, statErr := os.Stat(keysFile); statErr != nil {
+				return fmt.Errorf("admin API requires API keys, but key file %v cannot be used: %v (create a key with 'server keys add' or start with --api-insecure)", keysFile, statErr)
+			}
+			keys, keysErr := auth.OpenKeyStore(keysFile, nil)
+			if keysErr != nil {
+				return fmt.Errorf("Could not load API keys: %v", keysErr)
+			}
+			log.Printf("admin API requires API keys of %v", keysFile)
+			options = append(options, redirect.WithKeys(keys))
+		}
+
+		shortener, shortErr := storage.NewShortener(config.shortAlphabet, config.shortLength, config.shortReserved)
+		if shortErr != nil {
+			return fmt.Errorf("Invalid settings for short URLs: %v", shortErr)
+		}
+		options = append(options, redirect.WithShortener(shortener))
+	}
+	if config.fallback != "" {
+		options = append(options, redirect.WithFallback(config.fallback, config.fallbackCode))
+	}
+	var certStore *certs.Store
+	if config.tlsListenAddress != "" {
+		certDir := config.tlsCertDir
+		if certDir == "" {
+			certDir = config.redirectFile + ".certs"
+		}
+		certStore, err = certs.NewStore(certDir, nil)
+		if err != nil {
+			return err
+		}
+		if config.tlsSelfSigned {
+			log.Warnf("generating self-signed certificates for hostnames without certificate, only use this for development")
+			certStore.SelfSigned(func(hostname string) bool { return storage.HasOwnHost(redirector, hostname) })
+		}
+		options = append(options, redirect.WithTLS(config.tlsListenAddress, certStore))
+	}
+	if len(config.trustedProxies) > 0 {
+		proxies, proxyErr := parseNetworks(config.trustedProxies)
+		if proxyErr != nil {
+			return fmt.Errorf("Invalid trusted proxies: %v", proxyErr)
+		}
+		options = append(options, redirect.WithTrustedProxies(proxies))
+	} else if config.tlsListenAddress == "" {
+		// the admin API refuses new upgrades, loaded ones are kept as the server cannot tell how HTTPS requests arrive
+		for _, settings := range redirector.GetAllHostSettings() {
+			if settings.HTTPS {
+				log.Warnf("%v is upgraded to HTTPS without --tls-listen or --trusted-proxies, behind a proxy terminating TLS requests are redirected to themselves", settings.Hostname)
+			}
+		}
+	}
+	server = redirect.NewServer(config.listenAddress, options...)
+
+	// subscribe before starting, so no signal gets lost
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.StartServer()
 	}()
 
 	log.Printf("server started, waiting for interrupt")
 
-	// wait for interrupt
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	_ = <-c
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				if accessLog != nil {
+					log.Printf("received SIGUSR1, reopening access log %v", config.accessLogFile)
+					if reopenErr := accessLog.Reopen(); reopenErr != nil {
+						log.Errorf("could not reopen access log: %v", reopenErr)
+					}
+				}
+				continue
+			}
+			if sig != syscall.SIGHUP {
+				log.Printf("received signal %v, shutting down server", sig)
+				break wait
+			}
+			if certStore != nil {
+				log.Printf("received SIGHUP, reloading certificates")
+				if reloadErr := certStore.Reload(); reloadErr != nil {
+					log.Errorf("could not reload certificates: %v", reloadErr)
+				}
+			}
+			if reload == nil {
+				log.Printf("received SIGHUP, but there is no storage file to reload")
+				continue
+			}
+			log.Printf("received SIGHUP, reloading %v", config.redirectFile)
+			if reloadErr := reload(); reloadErr != nil {
+				log.Errorf("could not reload redirects: %v", reloadErr)
+			}
+		case err = <-serverErr:
+			log.Errorf("could not start server: %v", err)
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+		log.Errorf("server did not shut down gracefully: %v", shutdownErr)
+	}
+
 	log.Printf("server stopped")
+	return nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// knownContent is the content of the save file last loaded or written by the server.
+// The file watcher only reloads the file if it differs, i.e. if it was changed by someone else.
+var knownContent fileContent
+
+type fileContent struct {
+	mu  sync.Mutex
+	sum [sha256.Size]byte
+}
+
+func (c *fileContent) set(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sum = sha256.Sum256(b)
+}
+
+func (c *fileContent) equals(b []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum := sha256.Sum256(b)
+	return bytes.Equal(c.sum[:], sum[:])
+}
+
+//reloadFromFile parses the configuration file and passes the redirects to replace.
+//If the file cannot be loaded, replace is not called and the current redirects stay active.
+func reloadFromFile(configFile string, replace func(*storage.MapRedirect) error) error {
+	loaded := newMapRedirector()
+	if err := mapRedirectorFromFile(configFile, loaded); err != nil {
+		return fmt.Errorf("keeping current redirects, %v", err)
+	}
+
+	if err := replace(loaded); err != nil {
+		return fmt.Errorf("could not replace redirects: %v", err)
+	}
+	log.Printf("reloaded %v redirects from %v", len(loaded.GetAllRedirects()), configFile)
+	return nil
+}
+
+//watchFile checks the configuration file every interval and calls reload if it was changed by someone else.
+//Watching stops when the returned stop function is called.
+func watchFile(configFile string, interval time.Duration, reload func() error) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		last, _ := os.Stat(configFile)
+		for {
+			select {
+			case <-ticker.C:
+				info, err := os.Stat(configFile)
+				if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+					continue
+				}
+				last = info
+
+				b, err := ioutil.ReadFile(configFile)
+				if err != nil || knownContent.equals(b) {
+					continue
+				}
+
+				log.Printf("configuration file %v changed, reloading", configFile)
+				if err := reload(); err != nil {
+					log.Printf("could not reload configuration file: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
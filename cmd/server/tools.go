@@ -5,36 +5,45 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/flo80/redirect/pkg/storage"
 )
 
+//newMapRedirector returns an empty MapRedirect allowing the target schemes of --target-schemes
+func newMapRedirector() *storage.MapRedirect {
+	redirector := storage.NewMapRedirect(nil)
+	redirector.SetTargetSchemes(config.targetSchemes)
+	return redirector
+}
+
 //LoadFromFile loads configuration from a file (as json)
 func mapRedirectorFromFile(configFile string, redirector *storage.MapRedirect) error {
 
-	file, err := os.Open(configFile)
+	b, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return fmt.Errorf("configuration file %v not found: %v", configFile, err)
 	}
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(redirector)
+	err = json.Unmarshal(b, redirector)
 	if err != nil {
 		return fmt.Errorf("could not parse configuration file: %v", err)
 	}
 	log.Printf("decoded configuration file")
 
-	if err = file.Close(); err != nil {
-		return fmt.Errorf("could not close configuration file: %v ", err)
-	}
+	knownContent.set(b)
 	log.Printf("loaded configuration file %v", configFile)
 
 	return nil
 }
 
 //SaveMapRedirectorToFile saves configuration to a file (as json)
-func SaveMapRedirectorToFile(configFile string, redirector *storage.MapRedirect) error {
+//The file is replaced atomically, the previous version is kept as one of the newest backups (0 disables backups).
+//The save is recorded in saves, nil records nothing.
+func SaveMapRedirectorToFile(configFile string, redirector *storage.MapRedirect, backups int, saves *storage.SaveMetrics) error {
 	log.Printf("Trying to save config to file: %v", configFile)
 
 	b, err := json.MarshalIndent(redirector, "", " ")
@@ -43,10 +52,117 @@ func SaveMapRedirectorToFile(configFile string, redirector *storage.MapRedirect)
 		return fmt.Errorf("could not marshall config file: %v", err)
 	}
 
-	err = ioutil.WriteFile(configFile, b, 0644)
+	err = saves.SaveFile(configFile, b, backups)
 	if err != nil {
 		return fmt.Errorf("could not write config file: %v", err)
 	}
+	knownContent.set(b)
 	log.Printf("Config file %v written", configFile)
 	return nil
 }
+
+//autosave saves the redirector every interval to a file until the returned stop function is called
+func autosave(configFile string, redirector *storage.MapRedirect, interval time.Duration, backups int, saves *storage.SaveMetrics) (stop func()) {
+	return every(interval, func(time.Time) {
+		if err := SaveMapRedirectorToFile(configFile, redirector, backups, saves); err != nil {
+			log.Printf("autosave failed: %v", err)
+		}
+	})
+}
+
+//sweep removes expired redirects every interval, once they are expired for longer than grace, until the returned stop function is called
+func sweep(redirector storage.Redirector, interval, grace time.Duration) (stop func()) {
+	return every(interval, func(now time.Time) {
+		if removed := storage.RemoveExpired(redirector, now.Add(-grace), nil); removed > 0 {
+			log.Printf("removed %v expired redirects", removed)
+		}
+	})
+}
+
+//statsFromFile loads hit counters from a file (as json), a missing file is not an error
+func statsFromFile(statsFile string, stats *storage.Stats) error {
+	b, err := ioutil.ReadFile(statsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read hit counters %v: %v", statsFile, err)
+	}
+
+	if err = json.Unmarshal(b, stats); err != nil {
+		return fmt.Errorf("could not parse hit counters %v: %v", statsFile, err)
+	}
+	log.Printf("loaded hit counters %v", statsFile)
+	return nil
+}
+
+//saveStatsToFile saves hit counters to a file (as json), the file is replaced atomically without backups
+func saveStatsToFile(statsFile string, stats *storage.Stats, saves *storage.SaveMetrics) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("could not marshall hit counters: %v", err)
+	}
+
+	if err = saves.SaveFile(statsFile, b, 0); err != nil {
+		return fmt.Errorf("could not write hit counters %v: %v", statsFile, err)
+	}
+	return nil
+}
+
+//retainStats drops the hit counters of redirects which have been removed, the counter of the fallback (empty hostname) is kept
+func retainStats(stats *storage.Stats, redirector storage.Redirector) {
+	stats.Retain(func(hostname, url string) bool {
+		return hostname == "" || storage.HasRedirect(redirector, hostname, url)
+	})
+}
+
+//parseNetworks parses addresses and networks in CIDR notation, an address is a network of its own
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %v", value)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %v: %v", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//every calls f with the current time every interval until the returned stop function is called.
+//stop waits until a running call of f has returned.
+func every(interval time.Duration, f func(now time.Time)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case now := <-ticker.C:
+				f(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
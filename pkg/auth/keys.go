@@ -0,0 +1,260 @@
+// Package auth provides API keys for the admin API of the redirect server.
+// Only hashes of the keys are stored, the key itself is shown once when it is created.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flo80/redirect/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// scopes of keys
+const (
+	ScopeRead  = "read"  // list redirects, host settings, hit counters and metrics
+	ScopeWrite = "write" // everything of ScopeRead, add and delete redirects and change host settings
+)
+
+// Key is an API key as stored in the key file
+type Key struct {
+	ID      string    // public part of the key, used to find and revoke it
+	Name    string    `json:",omitempty"` // description, e.g. the owner of the key
+	Hash    string    // hex SHA-256 hash of the secret part of the key
+	Scope   string    // ScopeRead or ScopeWrite
+	Hosts   []string  `json:",omitempty"` // hostnames the key is limited to (*.example.com covers all subdomains), empty for all hostnames
+	Created time.Time // time the key was created
+}
+
+// keyFile is the format of the key file
+type keyFile struct {
+	Keys []Key
+}
+
+// Allows reports whether the key may access host, for changes write has to be true.
+// An empty host stands for requests spanning all hostnames, e.g. listing all redirects, which are not allowed for keys limited to hostnames.
+func (k Key) Allows(write bool, host string) bool {
+	if write && k.Scope != ScopeWrite {
+		return false
+	}
+	if len(k.Hosts) == 0 {
+		return true
+	}
+	if host == "" {
+		return false
+	}
+
+	host = storage.NormalizeHost(host)
+	for _, allowed := range k.Hosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScope checks that scope is a known scope
+func validateScope(scope string) error {
+	if scope != ScopeRead && scope != ScopeWrite {
+		return fmt.Errorf("invalid scope %v, allowed are %v and %v", scope, ScopeRead, ScopeWrite)
+	}
+	return nil
+}
+
+// KeyStore holds the API keys of a key file.
+// The file is read again when it was changed, so keys added or revoked by another process are used without restart.
+type KeyStore struct {
+	filename string
+	logger   *log.Logger
+
+	mu      sync.Mutex
+	keys    []Key
+	modTime time.Time // modification time of the file when it was read
+}
+
+// OpenKeyStore reads the keys of filename, a missing file is an empty key store (created when the first key is added).
+// Errors when reading changes are logged to logger, nil uses the standard logrus logger.
+func OpenKeyStore(filename string, logger *log.Logger) (*KeyStore, error) {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	s := &KeyStore{filename: filename, logger: logger}
+	if err := s.read(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// read replaces the keys with the keys of the file
+func (s *KeyStore) read() error {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return err
+	}
+
+	var file keyFile
+	if err = json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("could not parse key file %v: %v", s.filename, err)
+	}
+	s.keys, s.modTime = file.Keys, info.ModTime()
+	return nil
+}
+
+// refresh reads the file again if it was changed, on errors the previous keys are kept
+func (s *KeyStore) refresh() {
+	info, err := os.Stat(s.filename)
+	if err == nil && info.ModTime().Equal(s.modTime) {
+		return
+	}
+	if os.IsNotExist(err) && s.modTime.IsZero() {
+		return // no file yet (or already reported)
+	}
+	if err == nil {
+		err = s.read()
+	}
+	if err != nil {
+		s.logger.WithField("file", s.filename).Errorf("could not read key file, keeping previous keys: %v", err)
+		s.modTime = time.Time{}
+		return
+	}
+	s.logger.WithFields(log.Fields{"file": s.filename, "keys": len(s.keys)}).Info("key file reloaded")
+}
+
+// write saves the keys to the file, it is only readable by the owner
+func (s *KeyStore) write() error {
+	b, err := json.MarshalIndent(keyFile{s.keys}, "", " ")
+	if err != nil {
+		return err
+	}
+	if err = storage.WriteFileAtomic(s.filename, b, 0600); err != nil {
+		return fmt.Errorf("could not write key file %v: %v", s.filename, err)
+	}
+	if info, err := os.Stat(s.filename); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Authenticate returns the key of token, false if no key matches
+func (s *KeyStore) Authenticate(token string) (Key, bool) {
+	id, secret := splitToken(token)
+	if id == "" {
+		return Key{}, false
+	}
+	hash := hashSecret(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	for _, key := range s.keys {
+		if key.ID == id && subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Keys returns all keys sorted by creation time
+func (s *KeyStore) Keys() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	keys := append([]Key(nil), s.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// Add creates a new key and saves it in the file. The returned token is the key to send to the server, only its hash is stored.
+func (s *KeyStore) Add(name, scope string, hosts []string) (token string, key Key, err error) {
+	if err = validateScope(scope); err != nil {
+		return "", Key{}, err
+	}
+	for i, host := range hosts {
+		if host == "" {
+			return "", Key{}, fmt.Errorf("empty hostname")
+		}
+		hosts[i] = storage.NormalizeHost(host)
+	}
+
+	id, err := randomString(6)
+	if err != nil {
+		return "", Key{}, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", Key{}, err
+	}
+	key = Key{ID: id, Name: name, Hash: hashSecret(secret), Scope: scope, Hosts: hosts, Created: time.Now().UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	s.keys = append(s.keys, key)
+	if err = s.write(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return "", Key{}, err
+	}
+	return id + "." + secret, key, nil
+}
+
+// Revoke deletes the key with id from the file
+func (s *KeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	for i, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+		previous := s.keys
+		s.keys = append(append([]Key(nil), s.keys[:i]...), s.keys[i+1:]...)
+		if err := s.write(); err != nil {
+			s.keys = previous
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("key %v not found", id)
+}
+
+// splitToken splits a token (id.secret) in its parts, id is empty for malformed tokens
+func splitToken(token string) (id, secret string) {
+	i := strings.IndexByte(token, '.')
+	if i <= 0 || i == len(token)-1 {
+		return "", ""
+	}
+	return token[:i], token[i+1:]
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, encoded as URL-safe base64 without padding
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not create random key: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
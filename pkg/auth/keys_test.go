@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func openStore(t *testing.T) (*KeyStore, string) {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	s, err := OpenKeyStore(filename, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, filename
+}
+
+func TestAllows(t *testing.T) {
+	read := Key{Scope: ScopeRead}
+	write := Key{Scope: ScopeWrite}
+	limited := Key{Scope: ScopeWrite, Hosts: []string{"example.com", "*.example.org"}}
+
+	tests := []struct {
+		key   Key
+		write bool
+		host  string
+		want  bool
+	}{
+		{read, false, "", true},
+		{read, false, "example.com", true},
+		{read, true, "example.com", false},
+		{write, true, "", true},
+		{write, true, "example.com", true},
+		{limited, true, "example.com", true},
+		{limited, true, "EXAMPLE.com.", true},
+		{limited, false, "www.example.com", false},
+		{limited, true, "www.example.org", true},
+		{limited, true, "a.b.example.org", true},
+		{limited, true, "example.org", false},
+		{limited, true, "evilexample.org", false},
+		{limited, false, "", false},
+		{Key{Scope: ScopeRead, Hosts: []string{"example.com"}}, true, "example.com", false},
+	}
+	for _, test := range tests {
+		if got := test.key.Allows(test.write, test.host); got != test.want {
+			t.Errorf("key %v %v allows write %v for %q: %v, expected %v", test.key.Scope, test.key.Hosts, test.write, test.host, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s, filename := openStore(t)
+	token, key, err := s.Add("test", ScopeWrite, []string{"Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key.Hosts) != 1 || key.Hosts[0] != "example.com" {
+		t.Errorf("hosts of key are %v, expected normalized example.com", key.Hosts)
+	}
+
+	got, ok := s.Authenticate(token)
+	if !ok || got.ID != key.ID {
+		t.Fatalf("token %v is not accepted", token)
+	}
+	id, secret := splitToken(token)
+	for _, invalid := range []string{"", id, id + ".", "." + secret, id + "." + secret + "x", "other." + secret, key.Hash, id + "." + key.Hash} {
+		if _, ok := s.Authenticate(invalid); ok {
+			t.Errorf("token %q is accepted", invalid)
+		}
+	}
+
+	// only the hash of the secret is stored, the file is only readable by the owner
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), secret) {
+		t.Errorf("key file contains the secret of the key: %s", b)
+	}
+	if !strings.Contains(string(b), hashSecret(secret)) {
+		t.Errorf("key file does not contain the hash of the key: %s", b)
+	}
+
+	// keys are read by other key stores of the file, also after changes
+	other, err := OpenKeyStore(filename, s.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Authenticate(token); !ok {
+		t.Errorf("token is not accepted by another key store of the file")
+	}
+	if err = other.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Authenticate(token); ok {
+		t.Errorf("revoked token is accepted")
+	}
+	if err = other.Revoke(key.ID); err == nil {
+		t.Errorf("revoking a missing key returns no error")
+	}
+}
+
+func TestAddValidates(t *testing.T) {
+	s, _ := openStore(t)
+	if _, _, err := s.Add("test", "admin", nil); err == nil {
+		t.Errorf("unknown scope is accepted")
+	}
+	if _, _, err := s.Add("test", ScopeRead, []string{""}); err == nil {
+		t.Errorf("empty hostname is accepted")
+	}
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("invalid keys are stored: %v", keys)
+	}
+}
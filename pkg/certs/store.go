@@ -0,0 +1,461 @@
+// Package certs provides the certificates of the HTTPS listener of the redirect server.
+// Certificates are loaded from a directory of PEM files and selected by the hostname of the TLS handshake (SNI).
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flo80/redirect/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultName is the name of the default certificate, it is used for hostnames without own certificate
+const DefaultName = "default"
+
+// fileSuffix is the suffix of certificate files, every file contains the certificate chain and the private key
+const fileSuffix = ".pem"
+
+// selfSignedValidity is the validity of generated self-signed certificates
+const selfSignedValidity = 90 * 24 * time.Hour
+
+// maxGenerated is the maximum number of generated self-signed certificates kept, further ones replace older ones
+const maxGenerated = 1000
+
+// ErrNotFound is returned when a certificate to remove does not exist
+var ErrNotFound = errors.New("certificate not found")
+
+// NotAllowedError is returned by Put and Remove when a certificate is valid for a hostname it may not be changed for
+type NotAllowedError struct {
+	Hostname string // hostname of the certificate which is not allowed
+}
+
+func (e *NotAllowedError) Error() string {
+	return fmt.Sprintf("certificate is valid for %v, which is not allowed", e.Hostname)
+}
+
+// Certificate describes a loaded certificate, it does not contain the private key
+type Certificate struct {
+	Name      string    // DefaultName or the hostname the certificate was stored for, empty for files added to the directory by hand
+	File      string    // file of the certificate
+	Hostnames []string  // hostnames covered by the certificate (DNS names)
+	Issuer    string    // common name of the issuer
+	NotBefore time.Time // start of the validity
+	NotAfter  time.Time // end of the validity
+}
+
+// entry is a parsed certificate
+type entry struct {
+	info Certificate
+	cert *tls.Certificate
+}
+
+// Store holds all certificates of a directory by hostname
+type Store struct {
+	dir    string
+	logger *log.Logger
+
+	changes    sync.Mutex // serializes Put and Remove, so the checked certificate is the one replaced
+	mu         sync.RWMutex
+	entries    []entry                     // all certificates of the directory
+	byHost     map[string]*tls.Certificate // certificate for every hostname, the one valid longest wins
+	defaultCrt *tls.Certificate            // certificate of DefaultName, nil without default
+
+	selfSigned func(hostname string) bool  // hostnames to generate self-signed certificates for, nil disables it
+	generated  map[string]*tls.Certificate // generated self-signed certificates by hostname
+}
+
+// NewStore loads all certificates (*.pem) of dir, dir is created if it does not exist.
+// Errors are logged to logger, nil uses the standard logrus logger.
+func NewStore(dir string, logger *log.Logger) (*Store, error) {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create certificate directory %v: %v", dir, err)
+	}
+
+	s := &Store{dir: dir, logger: logger, generated: make(map[string]*tls.Certificate)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SelfSigned enables the generation of self-signed certificates for hostnames without certificate for which allowed returns true.
+// This is meant for development, browsers do not trust these certificates.
+func (s *Store) SelfSigned(allowed func(hostname string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selfSigned = allowed
+}
+
+// Reload reads all certificates of the directory again, files which cannot be parsed are logged and skipped.
+// The certificates are replaced at once, handshakes in progress are not affected.
+func (s *Store) Reload() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+fileSuffix))
+	if err != nil {
+		return err
+	}
+
+	var entries []entry
+	for _, file := range files {
+		e, err := loadFile(file)
+		if err != nil {
+			s.logger.WithField("file", file).Errorf("skipping certificate: %v", err)
+			continue
+		}
+		if e.info.NotAfter.Before(time.Now()) {
+			s.logger.WithFields(log.Fields{"file": file, "notAfter": e.info.NotAfter}).Warn("certificate is expired")
+		}
+		entries = append(entries, e)
+	}
+
+	byHost := make(map[string]*tls.Certificate)
+	var defaultCrt *tls.Certificate
+	sort.Slice(entries, func(i, j int) bool { return entries[i].info.NotAfter.Before(entries[j].info.NotAfter) })
+	for _, e := range entries {
+		// sorted by end of validity, so the certificate valid longest wins
+		for _, hostname := range e.info.Hostnames {
+			byHost[hostname] = e.cert
+		}
+		if e.info.Name == DefaultName {
+			defaultCrt = e.cert
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries, s.byHost, s.defaultCrt = entries, byHost, defaultCrt
+	s.logger.WithFields(log.Fields{"dir": s.dir, "certificates": len(entries)}).Info("certificates loaded")
+	return nil
+}
+
+// loadFile parses a PEM file with certificate chain and private key
+func loadFile(file string) (entry, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return entry{}, err
+	}
+	e, err := parse(b)
+	if err != nil {
+		return entry{}, err
+	}
+
+	e.info.File = file
+	name := strings.TrimSuffix(filepath.Base(file), fileSuffix)
+	if name == DefaultName {
+		e.info.Name = DefaultName
+	} else if hostname := nameFromFile(name); e.covers(hostname) {
+		e.info.Name = hostname
+	}
+	return e, nil
+}
+
+// parse parses certificate chain and private key of PEM data
+func parse(b []byte) (entry, error) {
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return entry{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return entry{}, err
+	}
+	cert.Leaf = leaf
+
+	hostnames := make([]string, 0, len(leaf.DNSNames))
+	for _, name := range leaf.DNSNames {
+		hostnames = append(hostnames, storage.NormalizeHost(name))
+	}
+	if len(hostnames) == 0 && leaf.Subject.CommonName != "" {
+		hostnames = append(hostnames, storage.NormalizeHost(leaf.Subject.CommonName))
+	}
+
+	return entry{
+		info: Certificate{
+			Hostnames: hostnames,
+			Issuer:    leaf.Issuer.CommonName,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		},
+		cert: &cert,
+	}, nil
+}
+
+// covers reports whether the certificate is valid for hostname, which can be a wildcard hostname
+func (e entry) covers(hostname string) bool {
+	for _, name := range e.info.Hostnames {
+		if name == hostname {
+			return true
+		}
+	}
+	return !strings.HasPrefix(hostname, "*") && e.cert.Leaf.VerifyHostname(hostname) == nil
+}
+
+// GetCertificate returns the certificate for the hostname of a TLS handshake (see tls.Config.GetCertificate):
+// the certificate of the hostname, of the wildcard hostname one level up (*.example.com for www.example.com),
+// a generated self-signed certificate (see SelfSigned) or the default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	hostname := storage.NormalizeHost(hello.ServerName)
+
+	s.mu.RLock()
+	cert := s.lookup(hostname)
+	selfSigned := s.selfSigned
+	defaultCrt := s.defaultCrt
+	s.mu.RUnlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+	if hostname != "" && selfSigned != nil && selfSigned(hostname) {
+		return s.generate(hostname)
+	}
+	if defaultCrt != nil {
+		return defaultCrt, nil
+	}
+	return nil, fmt.Errorf("no certificate for hostname %q", hostname)
+}
+
+// lookup returns the certificate of hostname or its wildcard hostname, s.mu has to be held
+func (s *Store) lookup(hostname string) *tls.Certificate {
+	if hostname == "" {
+		return nil
+	}
+	if cert, ok := s.byHost[hostname]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(hostname, '.'); i > 0 {
+		if cert, ok := s.byHost["*"+hostname[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// generate returns a self-signed certificate for hostname, it is created once and kept until it expires.
+// At most maxGenerated certificates are kept, expired ones are dropped first.
+func (s *Store) generate(hostname string) (*tls.Certificate, error) {
+	s.mu.RLock()
+	cert, ok := s.generated[hostname]
+	s.mu.RUnlock()
+	if ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	// the key is generated without lock, handshakes of other hostnames are not blocked
+	cert, err := selfSignedCertificate(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.generated[hostname]; ok && time.Now().Before(existing.Leaf.NotAfter) {
+		return existing, nil // generated by a concurrent handshake
+	}
+	if len(s.generated) >= maxGenerated {
+		s.dropGenerated()
+	}
+	s.generated[hostname] = cert
+	s.logger.WithField("hostname", hostname).Info("generated self-signed certificate")
+	return cert, nil
+}
+
+// dropGenerated removes expired generated certificates, or one of them if none is expired, s.mu has to be held
+func (s *Store) dropGenerated() {
+	now := time.Now()
+	for hostname, cert := range s.generated {
+		if !now.Before(cert.Leaf.NotAfter) {
+			delete(s.generated, hostname)
+		}
+	}
+	for hostname := range s.generated {
+		if len(s.generated) < maxGenerated {
+			return
+		}
+		delete(s.generated, hostname)
+	}
+}
+
+// selfSignedCertificate creates a self-signed certificate for hostname, valid for selfSignedValidity
+func selfSignedCertificate(hostname string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"redirect self-signed"}},
+		DNSNames:              []string{hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// List returns all certificates of the directory sorted by file
+func (s *Store) List() []Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Certificate, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].File < list[j].File })
+	return list
+}
+
+// Put validates PEM data (certificate chain and private key) for name (DefaultName or a hostname covered by the certificate),
+// stores it in the directory and reloads all certificates. The certificate is used for all its hostnames,
+// so allowed has to return true for every one of them and of the certificate it replaces, otherwise a NotAllowedError is returned.
+// nil allows all hostnames.
+func (s *Store) Put(name string, data []byte, allowed func(hostname string) bool) (Certificate, error) {
+	name = storage.NormalizeHost(name)
+	if !validName(name) {
+		return Certificate{}, fmt.Errorf("invalid certificate name %v", name)
+	}
+	e, err := parse(data)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("invalid certificate: %v", err)
+	}
+	if name != DefaultName && !e.covers(name) {
+		return Certificate{}, fmt.Errorf("invalid certificate: it is not valid for %v (valid for %v)", name, strings.Join(e.info.Hostnames, ", "))
+	}
+	if err = checkAllowed(e.info.Hostnames, allowed); err != nil {
+		return Certificate{}, err
+	}
+
+	file := filepath.Join(s.dir, fileFromName(name))
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	// replacing a certificate also drops it for all its hostnames
+	if existing, ok := s.stored(file); ok {
+		if err = checkAllowed(existing.Hostnames, allowed); err != nil {
+			return Certificate{}, err
+		}
+	}
+
+	if err = storage.WriteFileAtomic(file, data, 0600); err != nil {
+		return Certificate{}, fmt.Errorf("could not write certificate %v: %v", file, err)
+	}
+	if err = s.Reload(); err != nil {
+		return Certificate{}, err
+	}
+
+	e.info.Name, e.info.File = name, file
+	return e.info, nil
+}
+
+// Remove deletes the certificate stored for name (see Put) and reloads all certificates.
+// The certificate is dropped for all its hostnames, so allowed has to return true for every one of them,
+// otherwise a NotAllowedError is returned. nil allows all hostnames.
+func (s *Store) Remove(name string, allowed func(hostname string) bool) error {
+	name = storage.NormalizeHost(name)
+	if !validName(name) {
+		return ErrNotFound
+	}
+
+	file := filepath.Join(s.dir, fileFromName(name))
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	if existing, ok := s.stored(file); ok {
+		if err := checkAllowed(existing.Hostnames, allowed); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(file); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return s.Reload()
+}
+
+// stored returns the loaded certificate of file, e.g. of a name (see Put)
+func (s *Store) stored(file string) (Certificate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.entries {
+		if e.info.File == file {
+			return e.info, true
+		}
+	}
+	return Certificate{}, false
+}
+
+// checkAllowed returns a NotAllowedError for the first of hostnames for which allowed returns false, nil allows all hostnames
+func checkAllowed(hostnames []string, allowed func(hostname string) bool) error {
+	if allowed == nil {
+		return nil
+	}
+	for _, hostname := range hostnames {
+		if !allowed(hostname) {
+			return &NotAllowedError{hostname}
+		}
+	}
+	return nil
+}
+
+// validName checks that name is DefaultName or a hostname (optionally a wildcard), so it can be used as file name
+func validName(name string) bool {
+	if name == DefaultName {
+		return true
+	}
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileFromName returns the file name of the certificate of name, * of wildcard hostnames is replaced by _
+func fileFromName(name string) string {
+	return strings.Replace(name, "*", "_", 1) + fileSuffix
+}
+
+// nameFromFile returns the hostname of a file name without suffix (see fileFromName)
+func nameFromFile(name string) string {
+	if strings.HasPrefix(name, "_.") {
+		return "*" + name[1:]
+	}
+	return name
+}
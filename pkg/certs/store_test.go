@@ -0,0 +1,189 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pemCertificate returns PEM data of a self-signed certificate for hostnames and its private key
+func pemCertificate(t *testing.T, hostnames ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostnames[0]},
+		DNSNames:     hostnames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return b.Bytes()
+}
+
+// newStore returns an empty store in a temporary directory, which does not log
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	s, err := NewStore(t.TempDir(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// mustPut stores a certificate for hostnames under name
+func mustPut(t *testing.T, s *Store, name string, hostnames ...string) {
+	t.Helper()
+	if _, err := s.Put(name, pemCertificate(t, hostnames...), nil); err != nil {
+		t.Fatalf("could not store certificate %v: %v", name, err)
+	}
+}
+
+// served returns the first hostname of the certificate served for serverName, empty if there is none
+func served(s *Store, serverName string) string {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return ""
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return leaf.DNSNames[0]
+}
+
+func TestGetCertificate(t *testing.T) {
+	s := newStore(t)
+	mustPut(t, s, "example.com", "example.com", "www.example.com")
+	mustPut(t, s, "*.example.com", "*.example.com")
+	mustPut(t, s, "other.org", "other.org")
+
+	tests := []struct {
+		serverName string
+		served     string // first hostname of the served certificate, empty for none
+	}{
+		{"example.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"WWW.Example.com.", "example.com"},
+		{"api.example.com", "*.example.com"},
+		{"a.api.example.com", ""},
+		{"other.org", "other.org"},
+		{"unknown.net", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if name := served(s, tt.serverName); name != tt.served {
+			t.Errorf("certificate for %q is %q, expected %q", tt.serverName, name, tt.served)
+		}
+	}
+
+	mustPut(t, s, DefaultName, "fallback.example.net")
+	if name := served(s, "unknown.net"); name != "fallback.example.net" {
+		t.Errorf("certificate for a hostname without certificate is %q, expected the default certificate", name)
+	}
+}
+
+func TestPutChecksHostnames(t *testing.T) {
+	s := newStore(t)
+	allowed := func(hostname string) bool { return hostname == "example.com" }
+
+	if _, err := s.Put("example.com", pemCertificate(t, "example.com", "other.org"), allowed); err == nil {
+		t.Errorf("certificate with a hostname which is not allowed is stored")
+	} else if _, ok := err.(*NotAllowedError); !ok {
+		t.Errorf("certificate with a hostname which is not allowed returns %v, expected a NotAllowedError", err)
+	}
+	if _, err := s.Put("example.com", pemCertificate(t, "www.example.com"), nil); err == nil {
+		t.Errorf("certificate is stored for a hostname it is not valid for")
+	}
+	if _, err := s.Put("example.com", pemCertificate(t, "example.com"), allowed); err != nil {
+		t.Errorf("certificate with allowed hostnames is not stored: %v", err)
+	}
+}
+
+func TestReplaceAndRemoveCheckStoredHostnames(t *testing.T) {
+	s := newStore(t)
+	mustPut(t, s, "example.com", "example.com", "other.org")
+	allowed := func(hostname string) bool { return hostname == "example.com" }
+
+	// replacing or removing the certificate would drop it for other.org
+	if _, err := s.Put("example.com", pemCertificate(t, "example.com"), allowed); err == nil {
+		t.Errorf("certificate with a hostname which is not allowed is replaced")
+	} else if _, ok := err.(*NotAllowedError); !ok {
+		t.Errorf("replacing returns %v, expected a NotAllowedError", err)
+	}
+	if err := s.Remove("example.com", allowed); err == nil {
+		t.Errorf("certificate with a hostname which is not allowed is removed")
+	} else if _, ok := err.(*NotAllowedError); !ok {
+		t.Errorf("removing returns %v, expected a NotAllowedError", err)
+	}
+	if name := served(s, "other.org"); name != "example.com" {
+		t.Errorf("certificate for other.org is %q after refused changes, expected the stored certificate", name)
+	}
+
+	if err := s.Remove("example.com", nil); err != nil {
+		t.Errorf("certificate is not removed without restriction: %v", err)
+	}
+	if err := s.Remove("example.com", nil); err != ErrNotFound {
+		t.Errorf("removing a missing certificate returns %v, expected ErrNotFound", err)
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	s := newStore(t)
+	s.SelfSigned(func(hostname string) bool { return hostname != "unknown.net" })
+
+	first, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "dev.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Leaf.DNSNames[0] != "dev.example.com" {
+		t.Errorf("generated certificate is for %v, expected dev.example.com", first.Leaf.DNSNames)
+	}
+	if again, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "dev.example.com"}); again != first {
+		t.Errorf("certificate is generated again, expected the generated one")
+	}
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.net"}); err == nil {
+		t.Errorf("certificate is generated for a hostname which is not allowed")
+	}
+
+	// the number of generated certificates is bounded
+	for i := 0; i < maxGenerated+10; i++ {
+		if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("h%v.example.com", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.RLock()
+	generated := len(s.generated)
+	s.mu.RUnlock()
+	if generated > maxGenerated {
+		t.Errorf("%v generated certificates are kept, expected at most %v", generated, maxGenerated)
+	}
+}
@@ -0,0 +1,260 @@
+// Package metrics provides counters, gauges and histograms which are exported in the Prometheus text format.
+// It only implements what the redirect server needs, so the server does not depend on a monitoring framework.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets for durations in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a registered counter, gauge or histogram
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+// Registry contains metrics by name
+type Registry struct {
+	mu      sync.Mutex
+	names   []string // in order of registration
+	metrics map[string]metric
+	help    map[string]string
+	kind    map[string]string
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+		help:    make(map[string]string),
+		kind:    make(map[string]string),
+	}
+}
+
+// register adds a metric, if a metric with the same name and type exists, it is returned instead
+func (r *Registry) register(name, help, kind string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		if r.kind[name] != kind {
+			panic(fmt.Sprintf("metric %v is already registered as %v", name, r.kind[name]))
+		}
+		return existing
+	}
+	r.names = append(r.names, name)
+	r.metrics[name] = m
+	r.help[name] = help
+	r.kind[name] = kind
+	return m
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return r.register(name, help, "counter", &Counter{labels: labels, values: make(map[string]float64)}).(*Counter)
+}
+
+// NewGaugeFunc registers a gauge whose values are computed by f when the metrics are written.
+// f returns the values by label values (joined by labelSeparator, see Labels).
+func (r *Registry) NewGaugeFunc(name, help string, f func() map[string]float64, labels ...string) {
+	r.register(name, help, "gauge", &gaugeFunc{labels: labels, f: f})
+}
+
+// NewHistogram registers a histogram with the given upper bounds of the buckets and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return r.register(name, help, "histogram", &Histogram{labels: labels, buckets: sorted, values: make(map[string]*histogramValue)}).(*Histogram)
+}
+
+// WriteText writes all metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	names := append([]string(nil), r.names...)
+	r.mu.Unlock()
+
+	for _, name := range names {
+		r.mu.Lock()
+		m, help, kind := r.metrics[name], r.help[name], r.kind[name]
+		r.mu.Unlock()
+
+		fmt.Fprintf(w, "# HELP %v %v\n", name, escapeHelp(help))
+		fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+		m.write(w, name)
+	}
+}
+
+// ServeHTTP writes all metrics, so the registry can be used as handler for /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// labelSeparator joins label values to the key of a value
+const labelSeparator = "\xff"
+
+// Labels returns the key of label values, e.g. for the values of NewGaugeFunc
+func Labels(values ...string) string {
+	return strings.Join(values, labelSeparator)
+}
+
+// formatLabels returns the labels of a value as {name="value",...}, extra is added as last label
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSeparator)
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of values in a stable order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value which only increases, e.g. the number of requests
+type Counter struct {
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Inc increments the counter for the label values by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for the label values by v
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := Labels(labelValues...)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	c.mu.Lock()
+	values := make(map[string]float64, len(c.values))
+	for key, v := range c.values {
+		values[key] = v
+	}
+	c.mu.Unlock()
+
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(c.labels, key), formatFloat(values[key]))
+	}
+}
+
+// gaugeFunc is a gauge computed when the metrics are written
+type gaugeFunc struct {
+	labels []string
+	f      func() map[string]float64
+}
+
+func (g *gaugeFunc) write(w io.Writer, name string) {
+	values := g.f()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(g.labels, key), formatFloat(values[key]))
+	}
+}
+
+// Histogram counts observations in buckets, e.g. request durations
+type Histogram struct {
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // observations per bucket (not cumulative), the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// Observe adds an observation for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := Labels(labelValues...)
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with upper bound >= v
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = value
+	}
+	value.counts[i]++
+	value.sum += v
+	value.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := h.values[key]
+		var cumulative uint64
+		for i, count := range value.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%v_bucket%v %v\n", name, formatLabels(h.labels, key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_sum%v %v\n", name, formatLabels(h.labels, key), formatFloat(value.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", name, formatLabels(h.labels, key), value.count)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of the access log
+const (
+	// AccessLogCombined is the Combined Log Format (as Apache and nginx) followed by "host" "target" and the duration in seconds:
+	//	127.0.0.1 - - [02/Jan/2006:15:04:05 -0700] "GET /a HTTP/1.1" 307 - "referer" "user agent" "example.com" "https://target" 0.000123
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes one JSON object per request and line (see accessEntry for the fields)
+	AccessLogJSON = "json"
+)
+
+// accessLogBuffer is the number of entries which can wait to be written, further entries are dropped
+const accessLogBuffer = 4096
+
+// accessEntry is a request in the access log
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"` // request URI including query
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Target    string    `json:"target,omitempty"`
+	Duration  float64   `json:"duration"` // seconds
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// AccessLog writes requests to a file in the background, so logging does not slow down redirects.
+// If the file cannot keep up, entries are dropped instead of blocking requests.
+type AccessLog struct {
+	filename string // "-" for stdout
+	format   string
+	entries  chan accessEntry
+	reopen   chan chan error
+	done     chan struct{}
+	file     io.WriteCloser
+	w        *bufio.Writer
+	logger   *log.Logger // logger for write errors
+
+	mu     sync.RWMutex // guards closed, entries is only closed once no entry is queued
+	closed bool         // Close was called, further entries are dropped
+}
+
+// NewAccessLog opens filename ("-" for stdout) for appending and starts writing entries in the given format.
+// Write errors are logged to logger, nil uses the standard logrus logger.
+func NewAccessLog(filename, format string, logger *log.Logger) (*AccessLog, error) {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	if format != AccessLogCombined && format != AccessLogJSON {
+		return nil, fmt.Errorf("unknown access log format %v, allowed are %v and %v", format, AccessLogCombined, AccessLogJSON)
+	}
+
+	a := &AccessLog{
+		filename: filename,
+		format:   format,
+		entries:  make(chan accessEntry, accessLogBuffer),
+		reopen:   make(chan chan error),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	go a.run()
+	return a, nil
+}
+
+func (a *AccessLog) open() error {
+	if a.filename == "-" {
+		a.file = nopCloser{os.Stdout}
+	} else {
+		file, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open access log %v: %v", a.filename, err)
+		}
+		a.file = file
+	}
+	a.w = bufio.NewWriter(a.file)
+	return nil
+}
+
+// run writes all entries until the entries channel is closed, the buffer is flushed whenever no entry is waiting
+func (a *AccessLog) run() {
+	defer close(a.done)
+	for {
+		select {
+		case entry, ok := <-a.entries:
+			if !ok {
+				a.closeFile()
+				return
+			}
+			a.write(entry)
+			if len(a.entries) == 0 {
+				a.w.Flush()
+			}
+		case result := <-a.reopen:
+			a.closeFile()
+			result <- a.open()
+		}
+	}
+}
+
+func (a *AccessLog) write(e accessEntry) {
+	if a.w == nil {
+		return // reopen failed
+	}
+
+	if a.format == AccessLogJSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		a.w.Write(append(b, '\n'))
+		return
+	}
+
+	fmt.Fprintf(a.w, "%v - - [%v] %v %v - %v %v %v %v %v\n",
+		orDash(remoteHost(e.Remote)), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status,
+		strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)), strconv.Quote(e.Host), strconv.Quote(orDash(e.Target)),
+		strconv.FormatFloat(e.Duration, 'f', 6, 64))
+}
+
+func (a *AccessLog) closeFile() {
+	if a.w == nil {
+		return
+	}
+	if err := a.w.Flush(); err != nil {
+		a.logger.WithField("file", a.filename).Errorf("could not write access log: %v", err)
+	}
+	a.file.Close()
+	a.file, a.w = nil, nil
+}
+
+// log queues an entry, it never blocks. It returns false if the entry was dropped because writing could not keep up.
+// After Close entries are dropped silently, e.g. of requests still running when the server did not shut down in time.
+func (a *AccessLog) log(e accessEntry) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return true
+	}
+	select {
+	case a.entries <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reopen closes and reopens the file, e.g. after it was rotated by logrotate
+func (a *AccessLog) Reopen() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return fmt.Errorf("access log %v is closed", a.filename)
+	}
+	result := make(chan error)
+	a.reopen <- result
+	return <-result
+}
+
+// Close writes all waiting entries and closes the file, entries logged afterwards are dropped
+func (a *AccessLog) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// nopCloser does not close stdout
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// remoteHost returns the host of a remote address (host:port)
+func remoteHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// orDash returns s or "-" if s is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEntry is a request of the access log tests
+var testEntry = accessEntry{
+	Time: time.Date(2006, 1, 2, 15, 4, 5, 0, time.FixedZone("", -7*3600)), Remote: "192.0.2.1:1234", Method: "GET", Host: "example.com",
+	Path: "/a?b=c", Proto: "HTTP/1.1", Status: 307, Target: "https://example.org/", Duration: 0.000123, UserAgent: "test",
+}
+
+// writeAccessLog logs entries to a new access log of format and returns the written file
+func writeAccessLog(t *testing.T, format string, entries ...accessEntry) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "access.log")
+	a, err := NewAccessLog(file, format, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		a.log(e)
+	}
+	a.Close()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	combined := writeAccessLog(t, AccessLogCombined, testEntry)
+	expected := `192.0.2.1 - - [02/Jan/2006:15:04:05 -0700] "GET /a?b=c HTTP/1.1" 307 - "-" "test" "example.com" "https://example.org/" 0.000123` + "\n"
+	if combined != expected {
+		t.Errorf("combined access log is %q, expected %q", combined, expected)
+	}
+
+	var logged accessEntry
+	if err := json.Unmarshal([]byte(writeAccessLog(t, AccessLogJSON, testEntry)), &logged); err != nil {
+		t.Fatal(err)
+	}
+	if !logged.Time.Equal(testEntry.Time) || logged.Path != testEntry.Path || logged.Status != testEntry.Status || logged.Target != testEntry.Target {
+		t.Errorf("json access log is %+v, expected %+v", logged, testEntry)
+	}
+
+	if _, err := NewAccessLog(filepath.Join(t.TempDir(), "access.log"), "xml", nil); err == nil {
+		t.Errorf("unknown format is accepted")
+	}
+}
+
+func TestAccessLogAfterClose(t *testing.T) {
+	a, err := NewAccessLog(filepath.Join(t.TempDir(), "access.log"), AccessLogCombined, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests still running after a shutdown timeout log while the access log is closed
+	var requests sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for n := 0; n < 1000; n++ {
+				a.log(testEntry)
+			}
+		}()
+	}
+	a.Close()
+	requests.Wait()
+
+	a.log(testEntry)
+	a.Close()
+	if err := a.Reopen(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("reopening a closed access log returns %v, expected an error", err)
+	}
+}
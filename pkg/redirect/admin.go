@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixPrefix marks the address of a Unix socket, e.g. unix:/run/redirect/admin.sock
+const unixPrefix = "unix:"
+
+// WithAdminListener serves the admin API on its own address instead of the admin host of the listen address,
+// the listen address then only serves redirects. The address is ip:port or a Unix socket (unix:/path/to/socket),
+// timeout limits reading a request and writing a response of the admin API (0 for no limit).
+// The admin API is served for all hostnames on this address, the admin host of WithAdmin is not used.
+func WithAdminListener(address string, timeout time.Duration) Option {
+	return func(s *Server) {
+		s.adminListenAddress = address
+		s.adminTimeout = timeout
+	}
+}
+
+// registerAdmin registers all handlers of the admin API on mux, prefix is the admin host or empty for all hostnames
+func (s *Server) registerAdmin(mux *http.ServeMux, prefix string) {
+	mux.Handle(prefix+"/metrics", s.authorizeHandler(s.registry))
+	mux.HandleFunc(prefix+"/redirects/ping", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/list", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/add", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/shorten", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/delete", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/deleteHost", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/hosts", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/setHost", s.AdminAPI)
+	mux.HandleFunc(prefix+"/redirects/stats", s.AdminAPI)
+	mux.HandleFunc(prefix+apiV2Prefix, s.APIv2)
+}
+
+// listen opens a listener for address (ip:port or unix:/path/to/socket).
+// A socket file left over by a previous run is removed, a running server is detected by a successful connection.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixPrefix)
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/flo80/redirect/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiV2Prefix is the path of the v2 admin API on the admin host
+const apiV2Prefix = "/api/v2/"
+
+// maxBodySize is the maximum size of a JSON body of the v2 admin API
+const maxBodySize = 1 << 20
+
+// error codes of the v2 admin API
+const (
+	errUnauthorized       = "unauthorized"        // API key is missing or invalid
+	errForbidden          = "forbidden"           // API key does not allow the request (see auth.Key.Allows)
+	errNotFound           = "not_found"           // host or redirect does not exist, or unknown path
+	errMethodNotAllowed   = "method_not_allowed"  // method is not supported by the resource
+	errInvalidBody        = "invalid_body"        // body is not a valid JSON object of the resource
+	errInvalidRedirect    = "invalid_redirect"    // redirect is not valid (see storage.Redirect.Validate)
+	errInvalidSettings    = "invalid_settings"    // host settings are not valid (see storage.HostSettings.Validate)
+	errConflict           = "conflict"            // change conflicts with other redirects of the host (see storage.ConflictError)
+	errRedirectLoop       = "redirect_loop"       // change leads into a redirect loop (see storage.LoopError)
+	errInvalidCertificate = "invalid_certificate" // certificate cannot be parsed or is not valid for the hostname
+	errInvalidShort       = "invalid_short"       // shorten request is not valid (see storage.Shortener.Validate)
+	errStorage            = "storage_error"       // change could not be stored
+)
+
+// apiError is the body of all error responses of the v2 admin API
+type apiError struct {
+	Code    string // machine-readable error code, e.g. not_found
+	Message string // description of the error
+}
+
+// APIv2 is the http.Handler for the resource-style admin API
+// The API uses JSON bodies (storage.Redirect and storage.HostSettings) and HTTP status codes:
+//
+//   GET    /api/v2/hosts                           - 200, settings of all hosts with redirects or settings
+//   GET    /api/v2/hosts/{host}                    - 200, settings of host; 404 if it has neither redirects nor settings
+//   PUT    /api/v2/hosts/{host}                    - 201 (new host) or 200, replace the settings of host with the body
+//   DELETE /api/v2/hosts/{host}                    - 204, delete all redirects and settings of host; 404
+//   GET    /api/v2/hosts/{host}/redirects          - 200, all redirects of host; 404
+//   GET    /api/v2/hosts/{host}/redirects/{path}   - 200, redirect of host for URL /{path}; 404
+//   PUT    /api/v2/hosts/{host}/redirects/{path}   - 201 (with Location) or 200, add or replace the redirect with the body
+//   DELETE /api/v2/hosts/{host}/redirects/{path}   - 204, delete the redirect; 404
+//   POST   /api/v2/hosts/{host}/shorten            - 201 (with Location) or 200 (existing short URL), create a short URL for the
+//                                                    storage.ShortenRequest of the body, replies the redirect and its ShortURL
+//   GET    /api/v2/certificates                    - 200, all certificates of the HTTPS listener (see WithTLS)
+//   GET    /api/v2/certificates/{name}             - 200, certificate stored for name (a hostname or default); 404
+//   PUT    /api/v2/certificates/{name}             - 200, store the certificate chain and private key (PEM) of the body for name
+//   DELETE /api/v2/certificates/{name}             - 204, delete the certificate stored for name; 404
+//
+// {path} is the URL of the redirect without leading slash, the query of the request is part of the URL (e.g. search?lang=en).
+// A regular expression rule is given as percent-encoded path starting with ~ (e.g. ~%5E/user/%28%5Cd%2B%29$).
+// Hostname and URL of a body can be omitted, if given they have to match the path.
+//
+// With API keys (see WithKeys) GET requires a key with read access, PUT, POST and DELETE a key with write access.
+// GET /api/v2/hosts is not allowed for keys limited to hostnames.
+//
+// Errors are replied with 400 (invalid body or values), 401 (missing or invalid API key), 403 (API key does not allow the request),
+// 404, 405, 409 (conflict with other redirects of the host) or 500 (storage failed) and the body {"Code": "...", "Message": "..."}.
+// Changes leading into a redirect loop are invalid values (400).
+func (s *Server) APIv2(w http.ResponseWriter, r *http.Request) {
+	s.logger.WithFields(log.Fields{"remote": r.RemoteAddr, "method": r.Method, "url": r.URL.String()}).Debug("received v2 API request")
+	s.metrics.requestsTotal.Inc(outcomeAdmin)
+
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), apiV2Prefix), "/", 4)
+	if segments[0] == "certificates" {
+		s.apiV2Certificates(w, r, segments)
+		return
+	}
+	if segments[0] != "hosts" {
+		s.writeError(w, http.StatusNotFound, errNotFound, "unknown resource")
+		return
+	}
+
+	host, err := "", error(nil)
+	if len(segments) > 1 {
+		if host, err = url.PathUnescape(segments[1]); err != nil {
+			s.writeError(w, http.StatusBadRequest, errInvalidSettings, "invalid hostname")
+			return
+		}
+	}
+	if status, message := s.authorize(w, r, r.Method != http.MethodGet, host); status != 0 {
+		s.writeAuthError(w, status, message)
+		return
+	}
+
+	if host == "" {
+		if len(segments) > 2 {
+			s.writeError(w, http.StatusBadRequest, errInvalidSettings, "invalid hostname")
+		} else if allowMethods(w, r, http.MethodGet) {
+			s.writeJSON(w, http.StatusOK, s.allHostSettings())
+		}
+		return
+	}
+
+	switch {
+	case len(segments) == 2:
+		s.apiV2Host(w, r, host)
+	case segments[2] == "shorten" && len(segments) == 3:
+		s.apiV2Shorten(w, r, host)
+	case segments[2] != "redirects":
+		s.writeError(w, http.StatusNotFound, errNotFound, "unknown resource")
+	case len(segments) == 3:
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		if !s.hostExists(host) {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("host %v does not exist", host))
+			return
+		}
+		redirects := s.GetRedirectsForHost(host)
+		sort.Slice(redirects, func(i, j int) bool { return redirects[i].URL < redirects[j].URL })
+		s.writeJSON(w, http.StatusOK, redirects)
+	default:
+		path := segments[3]
+		if strings.HasPrefix(path, "~") {
+			path, err = url.PathUnescape(path)
+			if err != nil {
+				s.writeError(w, http.StatusBadRequest, errInvalidRedirect, "invalid regular expression encoding")
+				return
+			}
+		} else {
+			path = "/" + path
+			if r.URL.RawQuery != "" {
+				path += "?" + r.URL.RawQuery
+			}
+		}
+		s.apiV2Redirect(w, r, host, path)
+	}
+}
+
+// apiV2Host handles /api/v2/hosts/{host}
+func (s *Server) apiV2Host(w http.ResponseWriter, r *http.Request, host string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	exists := s.hostExists(host)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("host %v does not exist", host))
+			return
+		}
+		s.writeJSON(w, http.StatusOK, s.GetHostSettings(host))
+
+	case http.MethodPut:
+		var settings storage.HostSettings
+		if !s.readJSON(w, r, &settings) {
+			s.metrics.adminMutations.Inc("setHost", result(false))
+			return
+		}
+		if settings.Hostname != "" && storage.NormalizeHost(settings.Hostname) != storage.NormalizeHost(host) {
+			s.metrics.adminMutations.Inc("setHost", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidSettings, fmt.Sprintf("hostname %v does not match path", settings.Hostname))
+			return
+		}
+		settings.Hostname = host
+		if err := settings.Validate(s.targetSchemes...); err != nil {
+			s.metrics.adminMutations.Inc("setHost", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidSettings, err.Error())
+			return
+		}
+		if err := s.validateHTTPS(settings); err != nil {
+			s.metrics.adminMutations.Inc("setHost", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidSettings, err.Error())
+			return
+		}
+		if err := s.SetHostSettings(settings); err != nil {
+			s.metrics.adminMutations.Inc("setHost", result(false))
+			s.writeStorageError(w, err, errInvalidSettings)
+			return
+		}
+		s.metrics.adminMutations.Inc("setHost", result(true))
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		s.writeJSON(w, status, s.GetHostSettings(host))
+
+	case http.MethodDelete:
+		if !exists {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("host %v does not exist", host))
+			return
+		}
+		s.RemoveAllRedirectsForHost(storage.Redirect{Hostname: host})
+		if s.hostExists(host) {
+			s.metrics.adminMutations.Inc("deleteHost", result(false))
+			s.writeError(w, http.StatusInternalServerError, errStorage, fmt.Sprintf("host %v could not be deleted", host))
+			return
+		}
+		s.metrics.adminMutations.Inc("deleteHost", result(true))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiV2Redirect handles /api/v2/hosts/{host}/redirects/{path}
+func (s *Server) apiV2Redirect(w http.ResponseWriter, r *http.Request, host, path string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	existing := s.GetRedirect(host, path)
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(existing) == 0 {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("no redirect for host %v and url %v", host, path))
+			return
+		}
+		s.writeJSON(w, http.StatusOK, existing[0])
+
+	case http.MethodPut:
+		var redirect storage.Redirect
+		if !s.readJSON(w, r, &redirect) {
+			s.metrics.adminMutations.Inc("add", result(false))
+			return
+		}
+		if (redirect.Hostname != "" && storage.NormalizeHost(redirect.Hostname) != storage.NormalizeHost(host)) ||
+			(redirect.URL != "" && storage.NormalizeURL(redirect.URL) != storage.NormalizeURL(path)) {
+			s.metrics.adminMutations.Inc("add", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidRedirect, "hostname and url of the redirect do not match path")
+			return
+		}
+		redirect.Hostname, redirect.URL = host, path
+		if err := redirect.Validate(s.targetSchemes...); err != nil {
+			s.metrics.adminMutations.Inc("add", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidRedirect, err.Error())
+			return
+		}
+		if err := s.AddRedirect(redirect); err != nil {
+			s.metrics.adminMutations.Inc("add", result(false))
+			s.writeStorageError(w, err, errInvalidRedirect)
+			return
+		}
+		s.metrics.adminMutations.Inc("add", result(true))
+
+		stored := s.GetRedirect(host, path)
+		if len(stored) == 0 {
+			s.writeError(w, http.StatusInternalServerError, errStorage, "redirect was not stored")
+			return
+		}
+		status := http.StatusOK
+		if len(existing) == 0 {
+			status = http.StatusCreated
+			w.Header().Set("Location", redirectLocation(stored[0]))
+		}
+		s.writeJSON(w, status, stored[0])
+
+	case http.MethodDelete:
+		if len(existing) == 0 {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("no redirect for host %v and url %v", host, path))
+			return
+		}
+		s.RemoveRedirect(existing[0])
+		if len(s.GetRedirect(host, path)) > 0 {
+			s.metrics.adminMutations.Inc("delete", result(false))
+			s.writeError(w, http.StatusInternalServerError, errStorage, "redirect could not be deleted")
+			return
+		}
+		s.metrics.adminMutations.Inc("delete", result(true))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// hostExists reports whether host has redirects or settings
+func (s *Server) hostExists(host string) bool {
+	settings := s.GetHostSettings(host)
+	return settings != (storage.HostSettings{Hostname: settings.Hostname}) || len(s.GetRedirectsForHost(host)) > 0
+}
+
+// allHostSettings returns the settings of all hosts with redirects or settings, sorted by hostname
+func (s *Server) allHostSettings() []storage.HostSettings {
+	hostnames := make(map[string]bool)
+	for _, redirect := range s.GetAllRedirects() {
+		hostnames[redirect.Hostname] = true
+	}
+	for _, settings := range s.GetAllHostSettings() {
+		hostnames[settings.Hostname] = true
+	}
+
+	settings := make([]storage.HostSettings, 0, len(hostnames))
+	for hostname := range hostnames {
+		settings = append(settings, s.GetHostSettings(hostname))
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Hostname < settings[j].Hostname })
+	return settings
+}
+
+// redirectLocation returns the path of a redirect in the v2 admin API
+func redirectLocation(redirect storage.Redirect) string {
+	location := apiV2Prefix + "hosts/" + url.PathEscape(redirect.Hostname) + "/redirects"
+	if strings.HasPrefix(redirect.URL, "~") {
+		return location + "/" + url.PathEscape(redirect.URL)
+	}
+	return location + redirect.URL
+}
+
+// allowMethods replies 405 Method Not Allowed if the method of the request is not one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{errMethodNotAllowed, fmt.Sprintf("method %v is not allowed", r.Method)})
+	return false
+}
+
+// readJSON decodes the body of the request into v, if it fails it replies 400 Bad Request
+func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		s.writeError(w, http.StatusBadRequest, errInvalidBody, fmt.Sprintf("invalid body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeStorageError replies 400 Bad Request for a storage.ValidationError (with code invalid) or storage.LoopError,
+// 409 Conflict for a storage.ConflictError, 500 Internal Server Error for other errors.
+// The storage can reject changes the API accepted, e.g. with other target schemes.
+func (s *Server) writeStorageError(w http.ResponseWriter, err error, invalid string) {
+	switch err.(type) {
+	case *storage.ValidationError:
+		s.writeError(w, http.StatusBadRequest, invalid, err.Error())
+		return
+	case *storage.LoopError:
+		s.writeError(w, http.StatusBadRequest, errRedirectLoop, err.Error())
+		return
+	case *storage.ConflictError, *storage.ExistsError:
+		s.writeError(w, http.StatusConflict, errConflict, err.Error())
+		return
+	}
+	s.writeError(w, http.StatusInternalServerError, errStorage, err.Error())
+}
+
+// writeAuthError replies the result of authorize
+func (s *Server) writeAuthError(w http.ResponseWriter, status int, message string) {
+	code := errUnauthorized
+	if status == http.StatusForbidden {
+		code = errForbidden
+	}
+	s.writeError(w, status, code, message)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, code, message string) {
+	s.logger.WithFields(log.Fields{"status": status, "code": code}).Debugf("v2 API error: %v", message)
+	writeJSON(w, status, apiError{code, message})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	s.logger.WithField("status", status).Debug("sending v2 API response")
+	writeJSON(w, status, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
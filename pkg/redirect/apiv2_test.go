@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// apiStep is a request to the admin API and its expected response, the steps of a test run in order
+type apiStep struct {
+	method string
+	path   string // path below /api/v2/
+	body   string
+	status int
+	code   string // error code of the response, empty for success
+}
+
+// runSteps sends the requests of steps to s with token in order
+func runSteps(t *testing.T, s *Server, token string, steps []apiStep) {
+	t.Helper()
+	for _, step := range steps {
+		w := serve(s, step.method, "http://"+adminHost+apiV2Prefix+step.path, step.body, token)
+		if w.Code != step.status {
+			t.Errorf("%v %v returns %v, expected %v: %v", step.method, step.path, w.Code, step.status, w.Body)
+			continue
+		}
+		if step.code == "" {
+			continue
+		}
+		var e apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != step.code {
+			t.Errorf("%v %v returns error %q, expected %q: %v", step.method, step.path, e.Code, step.code, w.Body)
+		}
+	}
+}
+
+func TestAPIv2StatusCodes(t *testing.T) {
+	s := newTestServer(t)
+	runSteps(t, s, "", []apiStep{
+		{"GET", "hosts/example.com", "", 404, errNotFound},
+		{"PUT", "hosts/example.com/redirects/a", `{"Target": "https://example.org/a"}`, 201, ""},
+		{"PUT", "hosts/example.com/redirects/a", `{"Target": "https://example.org/b", "Code": 301}`, 200, ""},
+		{"GET", "hosts/example.com/redirects/a", "", 200, ""},
+		{"GET", "hosts/example.com/redirects", "", 200, ""},
+		{"GET", "hosts/example.com", "", 200, ""},
+		{"GET", "hosts", "", 200, ""},
+		{"GET", "hosts/example.com/redirects/missing", "", 404, errNotFound},
+		{"GET", "hosts/unknown.com/redirects", "", 404, errNotFound},
+		{"GET", "unknown", "", 404, errNotFound},
+		{"POST", "hosts/example.com/redirects/a", "", 405, errMethodNotAllowed},
+
+		// invalid bodies and values
+		{"PUT", "hosts/example.com/redirects/b", `{"Target":`, 400, errInvalidBody},
+		{"PUT", "hosts/example.com/redirects/b", `{"Target": "https://example.org/", "Unknown": 1}`, 400, errInvalidBody},
+		{"PUT", "hosts/example.com/redirects/b", `{"Target": "javascript:alert(1)"}`, 400, errInvalidRedirect},
+		{"PUT", "hosts/example.com/redirects/b", `{"Target": "//evil.com/"}`, 400, errInvalidRedirect},
+		{"PUT", "hosts/example.com/redirects/b", `{"Target": "https://example.org/", "Code": 200}`, 400, errInvalidRedirect},
+		{"PUT", "hosts/example.com/redirects/b", `{"URL": "/c", "Target": "https://example.org/"}`, 400, errInvalidRedirect},
+		{"PUT", "hosts/example.com", `{"DefaultCode": 301}`, 400, errInvalidSettings},
+		{"PUT", "hosts/example.com", `{"Hostname": "other.com"}`, 400, errInvalidSettings},
+
+		// loops are invalid values, equal URLs conflict with the other redirects of the host
+		{"PUT", "hosts/example.com/redirects/self", `{"Target": "/self"}`, 400, errRedirectLoop},
+		{"PUT", "hosts/example.com/redirects/x", `{"Target": "/y"}`, 201, ""},
+		{"PUT", "hosts/example.com/redirects/y", `{"Target": "https://example.com/x"}`, 400, errRedirectLoop},
+		{"PUT", "hosts/example.com/redirects/A", `{"Target": "https://example.org/"}`, 201, ""},
+		{"PUT", "hosts/example.com", `{"IgnoreCase": true}`, 409, errConflict},
+		{"PUT", "hosts/example.com", `{"Query": "pass"}`, 200, ""},
+
+		{"DELETE", "hosts/example.com/redirects/a", "", 204, ""},
+		{"DELETE", "hosts/example.com/redirects/a", "", 404, errNotFound},
+		{"DELETE", "hosts/example.com", "", 204, ""},
+		{"DELETE", "hosts/example.com", "", 404, errNotFound},
+		{"PUT", "hosts/new.com", `{"Default": "https://example.org/"}`, 201, ""},
+	})
+}
+
+func TestAPIv2StorageValidation(t *testing.T) {
+	// the storage allows fewer schemes than the API, its ValidationError is a client error as well
+	red := storage.NewMapRedirect(quietLogger())
+	s := newTestServer(t, WithRedirector(red), WithTargetSchemes([]string{"http", "https", "mailto"}))
+	runSteps(t, s, "", []apiStep{
+		{"PUT", "hosts/example.com/redirects/mail", `{"Target": "mailto:someone@example.com"}`, 400, errInvalidRedirect},
+		{"PUT", "hosts/example.com", `{"Default": "mailto:someone@example.com"}`, 400, errInvalidSettings},
+		{"POST", "hosts/example.com/shorten", `{"Target": "mailto:someone@example.com"}`, 400, errInvalidShort},
+	})
+}
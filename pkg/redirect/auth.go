@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flo80/redirect/pkg/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithKeys requires an API key of keys for all admin requests (except ping).
+// Keys are sent as bearer token: Authorization: Bearer <key>
+func WithKeys(keys *auth.KeyStore) Option {
+	return func(s *Server) { s.keys = keys }
+}
+
+// authorize checks the API key of an admin request for host (empty for requests spanning all hostnames), for changes write has to be true.
+// It returns 0 if the request is allowed, otherwise the HTTP status code to reply (401 Unauthorized or 403 Forbidden) and a message.
+// Without key store all requests are allowed.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, write bool, host string) (status int, message string) {
+	if s.keys == nil {
+		return 0, ""
+	}
+
+	logger := s.logger.WithFields(log.Fields{"remote": r.RemoteAddr, "url": r.URL.String()})
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="redirect"`)
+		logger.Info("admin request without API key")
+		return http.StatusUnauthorized, "API key required"
+	}
+	key, ok := s.keys.Authenticate(token)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="redirect", error="invalid_token"`)
+		logger.Warn("admin request with invalid API key")
+		return http.StatusUnauthorized, "invalid API key"
+	}
+	if !key.Allows(write, host) {
+		logger.WithField("key", key.ID).Warn("admin request not allowed for API key")
+		return http.StatusForbidden, "API key does not allow this request"
+	}
+	return 0, ""
+}
+
+// bearerToken returns the API key of a request, false if it has none
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), true
+}
+
+// allowedHosts returns a function reporting whether the API key of an admin request may change a hostname.
+// Without key store all hostnames are allowed.
+func (s *Server) allowedHosts(r *http.Request) func(hostname string) bool {
+	if s.keys == nil {
+		return nil
+	}
+	token, _ := bearerToken(r)
+	key, ok := s.keys.Authenticate(token)
+	return func(hostname string) bool {
+		return ok && key.Allows(true, hostname)
+	}
+}
+
+// authorizeHandler wraps handler, so it requires an API key with read access to all hostnames
+func (s *Server) authorizeHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, message := s.authorize(w, r, false, ""); status != 0 {
+			http.Error(w, message, status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/flo80/redirect/pkg/auth"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	keys := newKeyStore(t)
+	s := newTestServer(t, WithKeys(keys))
+	write := addKey(t, keys, auth.ScopeWrite)
+	read := addKey(t, keys, auth.ScopeRead)
+	limited := addKey(t, keys, auth.ScopeWrite, "*.example.com")
+
+	runSteps(t, s, write, []apiStep{
+		{"PUT", "hosts/www.example.com/redirects/a", `{"Target": "https://example.org/"}`, 201, ""},
+		{"PUT", "hosts/example.org/redirects/a", `{"Target": "https://example.org/"}`, 201, ""},
+	})
+	runSteps(t, s, "", []apiStep{
+		{"GET", "hosts", "", 401, errUnauthorized},
+		{"GET", "hosts/www.example.com", "", 401, errUnauthorized},
+	})
+	runSteps(t, s, write+"x", []apiStep{
+		{"GET", "hosts", "", 401, errUnauthorized},
+	})
+	runSteps(t, s, read, []apiStep{
+		{"GET", "hosts", "", 200, ""},
+		{"GET", "hosts/example.org/redirects/a", "", 200, ""},
+		{"PUT", "hosts/example.org/redirects/b", `{"Target": "https://example.org/"}`, 403, errForbidden},
+		{"DELETE", "hosts/example.org/redirects/a", "", 403, errForbidden},
+		{"POST", "hosts/example.org/shorten", `{"Target": "https://example.org/"}`, 403, errForbidden},
+	})
+	runSteps(t, s, limited, []apiStep{
+		{"GET", "hosts", "", 403, errForbidden},
+		{"GET", "hosts/www.example.com/redirects/a", "", 200, ""},
+		{"PUT", "hosts/api.example.com/redirects/a", `{"Target": "https://example.org/"}`, 201, ""},
+		{"GET", "hosts/example.org/redirects/a", "", 403, errForbidden},
+		{"DELETE", "hosts/example.org", "", 403, errForbidden},
+		{"PUT", "hosts/example.com/redirects/a", `{"Target": "https://example.org/"}`, 403, errForbidden},
+	})
+
+	// ping is allowed without key, the other requests of the old API require one
+	if w := serve(s, "GET", "http://"+adminHost+"/redirects/ping", "", ""); w.Code != 200 {
+		t.Errorf("ping without key returns %v", w.Code)
+	}
+	if w := serve(s, "GET", "http://"+adminHost+"/redirects/list", "", ""); w.Code != 401 {
+		t.Errorf("list without key returns %v, expected 401", w.Code)
+	}
+	if w := serve(s, "GET", "http://"+adminHost+"/redirects/list", "", read); w.Code != 200 {
+		t.Errorf("list with read key returns %v", w.Code)
+	}
+	if w := serve(s, "GET", "http://"+adminHost+"/metrics", "", ""); w.Code != 401 {
+		t.Errorf("metrics without key returns %v, expected 401", w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/flo80/redirect/pkg/metrics"
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// outcomes of requests
+const (
+	outcomeRedirected = "redirected" // redirect of the storage (including default targets)
+	outcomeFallback   = "fallback"   // redirect to the fallback target of the server
+	outcomeNotFound   = "not_found"  // no redirect, replied 404 Not Found
+	outcomeAdmin      = "admin"      // request of the admin API
+
+	outcomeHTTPSUpgrade = "https_upgrade" // plain HTTP request redirected to HTTPS (see storage.HostSettings.HTTPS)
+)
+
+// WithMetrics exports the metrics of the server in registry, e.g. to add the metrics of the storage (see storage.NewSaveMetrics).
+// Per default each server has its own registry. A registry cannot be shared by servers,
+// the redirect table size of the first server would be exported for all of them.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(s *Server) { s.registry = registry }
+}
+
+// serverMetrics are the metrics of a server, registered in its registry
+type serverMetrics struct {
+	requestsTotal    *metrics.Counter
+	requestDuration  *metrics.Histogram
+	adminMutations   *metrics.Counter
+	accessLogDropped *metrics.Counter
+}
+
+// newServerMetrics registers the metrics of a server with redirector in registry
+func newServerMetrics(registry *metrics.Registry, redirector storage.Redirector) *serverMetrics {
+	registry.NewGaugeFunc("redirect_table_size", "Number of redirects per hostname.", func() map[string]float64 {
+		sizes := make(map[string]float64)
+		for _, redirect := range redirector.GetAllRedirects() {
+			sizes[metrics.Labels(redirect.Hostname)]++
+		}
+		return sizes
+	}, "host")
+
+	return &serverMetrics{
+		requestsTotal: registry.NewCounter("redirect_requests_total",
+			"Number of requests by outcome (redirected, fallback, https_upgrade, not_found, admin).", "outcome"),
+		requestDuration: registry.NewHistogram("redirect_request_duration_seconds",
+			"Duration of handling redirect requests in seconds by outcome.", metrics.DefaultBuckets, "outcome"),
+		adminMutations: registry.NewCounter("redirect_admin_mutations_total",
+			"Number of changes through the admin API by function and result (success, failure).", "function", "result"),
+		accessLogDropped: registry.NewCounter("redirect_access_log_dropped_total",
+			"Number of access log entries dropped because writing could not keep up."),
+	}
+}
+
+// result returns the result label of an admin mutation
+func result(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flo80/redirect/pkg/metrics"
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+func TestMetricsPerServer(t *testing.T) {
+	first, second := storage.NewMapRedirect(quietLogger()), storage.NewMapRedirect(quietLogger())
+	first.AddRedirect(storage.Redirect{Hostname: "first.com", URL: "/a", Target: "https://example.org/"})
+	second.AddRedirect(storage.Redirect{Hostname: "second.com", URL: "/a", Target: "https://example.org/"})
+	second.AddRedirect(storage.Redirect{Hostname: "second.com", URL: "/b", Target: "https://example.org/"})
+
+	registry := metrics.NewRegistry()
+	storage.NewSaveMetrics(registry)
+	servers := []*Server{newTestServer(t, WithRedirector(first), WithMetrics(registry)), newTestServer(t, WithRedirector(second))}
+	serve(servers[1], "GET", "http://second.com/a", "", "")
+
+	tests := []struct {
+		contains    []string
+		notContains []string
+	}{
+		{
+			[]string{`redirect_table_size{host="first.com"} 1`, "redirect_saves_total"},
+			[]string{"second.com", `outcome="redirected"`},
+		},
+		{
+			[]string{`redirect_table_size{host="second.com"} 2`, `redirect_requests_total{outcome="redirected"} 1`},
+			[]string{"first.com", "redirect_saves_total"},
+		},
+	}
+	for i, test := range tests {
+		w := serve(servers[i], "GET", "http://"+adminHost+"/metrics", "", "")
+		body := w.Body.String()
+		for _, s := range test.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("metrics of server %v do not contain %v:\n%v", i, s, body)
+			}
+		}
+		for _, s := range test.notContains {
+			if strings.Contains(body, s) {
+				t.Errorf("metrics of server %v contain %v:\n%v", i, s, body)
+			}
+		}
+	}
+}
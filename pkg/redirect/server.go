@@ -1,10 +1,21 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	stdlog "log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/flo80/redirect/pkg/auth"
+	"github.com/flo80/redirect/pkg/certs"
+	"github.com/flo80/redirect/pkg/metrics"
 	"github.com/flo80/redirect/pkg/storage"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,63 +24,200 @@ type responseStatus struct {
 	Status  bool
 	Message string
 	Content []storage.Redirect
+	Hosts   []storage.HostSettings `json:",omitempty"`
+	Stats   []storage.HitCount     `json:",omitempty"`
 }
 
 // Server settings for redirect server
 type Server struct {
-	listenAddress      string         // ip:port to listen on, for all interfaces empty, e.g. ":8080"
-	adminHost          string         // hostname for administration of redirects (REST API at /redirects)
-	storage.Redirector                // storage of all redirects: hostname, URL, target
-	mux                *http.ServeMux // mux for handlers
-	logger             *log.Logger    //logger to be used BUG: not yet implemented
+	listenAddress      string             // ip:port to listen on, for all interfaces empty, e.g. ":8080"
+	adminHost          string             // hostname for administration of redirects (REST API at /redirects)
+	storage.Redirector                    // storage of all redirects: hostname, URL, target
+	mux                *http.ServeMux     // mux for handlers
+	logger             *log.Logger        // logger for all output of the server and the default storage
+	httpServer         *http.Server       // server listening on listenAddress, created by NewServer
+	fallback           string             // target for requests without redirect, empty for 404 Not Found
+	fallbackCode       int                // HTTP status code of the fallback redirect, 0 for storage.DefaultCode
+	stats              *storage.Stats     // hit counters of all redirects
+	accessLog          *AccessLog         // access log of redirect requests, nil logs a line per request to the logger
+	keys               *auth.KeyStore     // API keys required for the admin API, nil allows all admin requests
+	adminListenAddress string             // ip:port or unix:/path of the admin API, empty serves it on adminHost of listenAddress
+	adminTimeout       time.Duration      // read and write timeout of the admin listener, 0 for no limit
+	adminServer        *http.Server       // server listening on adminListenAddress, nil without admin listener
+	certs              *certs.Store       // certificates of the HTTPS listener, nil without HTTPS
+	tlsServer          *http.Server       // server listening for HTTPS, nil without HTTPS
+	trustedProxies     []*net.IPNet       // proxies whose X-Forwarded-Proto header is trusted, e.g. terminating TLS
+	shortener          *storage.Shortener // creates short URLs for the shorten function of the admin API
+	targetSchemes      []string           // URL schemes allowed for targets, nil for storage.DefaultTargetSchemes
+	registry           *metrics.Registry  // registry exporting the metrics of the server at /metrics
+	metrics            *serverMetrics     // metrics of the server, registered in registry
 }
 
 // NewServer creates new server, sets handle functions but does not start listening.
-// Per default it uses http.DefaultServeMux, a default ruslog logger and an empty MapRedirect for storage
+// Per default it uses http.DefaultServeMux, the standard logrus logger, an empty MapRedirect (using the same logger) for storage
+// and a new metrics registry
 func NewServer(listenAddress string, opts ...Option) *Server {
-	redirector := storage.MapRedirect{}
-
 	s := &Server{
 		listenAddress: listenAddress,
 		adminHost:     "",
-		Redirector:    &redirector,
 		mux:           http.DefaultServeMux,
-		logger:        &log.Logger{},
+		logger:        log.StandardLogger(),
+		stats:         &storage.Stats{},
+		shortener:     defaultShortener(),
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.Redirector == nil {
+		redirector := storage.NewMapRedirect(s.logger)
+		redirector.SetTargetSchemes(s.targetSchemes)
+		s.Redirector = redirector
+	}
+	if s.registry == nil {
+		s.registry = metrics.NewRegistry()
+	}
+	s.metrics = newServerMetrics(s.registry, s.Redirector)
 
 	s.mux.HandleFunc("/", s.Handler)
 
-	if s.adminHost != "" {
-		s.mux.HandleFunc(s.adminHost+"/redirects/ping", s.AdminAPI)
-		s.mux.HandleFunc(s.adminHost+"/redirects/list", s.AdminAPI)
-		s.mux.HandleFunc(s.adminHost+"/redirects/add", s.AdminAPI)
-		s.mux.HandleFunc(s.adminHost+"/redirects/delete", s.AdminAPI)
-		s.mux.HandleFunc(s.adminHost+"/redirects/deleteHost", s.AdminAPI)
+	if s.adminListenAddress != "" {
+		adminMux := http.NewServeMux()
+		s.registerAdmin(adminMux, "")
+		s.adminServer = &http.Server{
+			Addr:         s.adminListenAddress,
+			Handler:      adminMux,
+			ReadTimeout:  s.adminTimeout,
+			WriteTimeout: s.adminTimeout,
+		}
+	} else if s.adminHost != "" {
+		s.registerAdmin(s.mux, s.adminHost)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:     s.listenAddress,
+		Handler:  s.mux,
+		ErrorLog: s.errorLog(),
+	}
+	if s.tlsServer != nil {
+		s.tlsServer.Handler = s.mux
+		s.tlsServer.ErrorLog = s.errorLog()
+	}
+	if s.adminServer != nil {
+		s.adminServer.ErrorLog = s.errorLog()
 	}
 	return s
 }
 
-//StartServer calls http.ListenAndServe
+//StartServer listens on the listen address (and the admin listen address) and serves requests until the server is shut down.
+//After Shutdown it returns http.ErrServerClosed.
 func (s *Server) StartServer() error {
-	log.Printf("Starting redirect server on address %v", s.listenAddress)
-	return http.ListenAndServe(s.listenAddress, s.mux)
+	if s.adminServer != nil {
+		listener, err := listen(s.adminListenAddress)
+		if err != nil {
+			return err
+		}
+		s.serveBackground(s.adminServer, listener, "admin API")
+	}
+	if s.tlsServer != nil {
+		listener, err := net.Listen("tcp", s.tlsServer.Addr)
+		if err != nil {
+			s.closeBackground()
+			return err
+		}
+		s.serveBackground(s.tlsServer, tls.NewListener(listener, s.tlsServer.TLSConfig), "HTTPS redirect server")
+	}
+
+	s.logger.WithField("address", s.listenAddress).Info("Starting redirect server")
+	err := s.httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		s.closeBackground()
+	}
+	return err
+}
+
+// errorLog returns a log.Logger of the standard library for errors of an http.Server (e.g. failed TLS handshakes), which writes to the logger
+func (s *Server) errorLog() *stdlog.Logger {
+	return stdlog.New(s.logger.WriterLevel(log.WarnLevel), "", 0)
+}
+
+// serveBackground serves requests of listener with server until it is shut down
+func (s *Server) serveBackground(server *http.Server, listener net.Listener, name string) {
+	logger := s.logger.WithField("address", server.Addr)
+	logger.Infof("Starting %v", name)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("%v stopped: %v", name, err)
+		}
+	}()
+}
+
+// closeBackground closes the admin and HTTPS servers, if the redirect server could not be started
+func (s *Server) closeBackground() {
+	for _, server := range []*http.Server{s.adminServer, s.tlsServer} {
+		if server != nil {
+			server.Close()
+		}
+	}
+}
+
+//Shutdown stops listening and waits until all requests in progress are finished or ctx is done (see http.Server.Shutdown)
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, server := range []*http.Server{s.adminServer, s.tlsServer} {
+		if server == nil {
+			continue
+		}
+		s.logger.WithField("address", server.Addr).Info("Shutting down listener")
+		if err := server.Shutdown(ctx); err != nil {
+			s.logger.WithField("address", server.Addr).Errorf("listener did not shut down gracefully: %v", err)
+		}
+	}
+
+	s.logger.WithField("address", s.listenAddress).Info("Shutting down redirect server")
+	return s.httpServer.Shutdown(ctx)
 }
 
 // Option defines options to set for server
 type Option func(*Server)
 
-// WithAdmin allows to enable the REST API
+// WithAdmin allows to enable the REST API on the admin host of the listen address (see WithAdminListener for an own address)
 func WithAdmin(adminHost string) Option {
 	return func(s *Server) { s.adminHost = adminHost }
 }
 
-// WithLogger allows to pass a custom logger
+// WithLogger allows to pass a custom logger, it is used for all output of the server and the default storage.
+// A storage passed with WithRedirector needs its own logger (e.g. storage.NewMapRedirect(logger)).
 func WithLogger(logger *log.Logger) Option {
-	return func(s *Server) { s.logger = logger }
+	return func(s *Server) {
+		if logger != nil {
+			s.logger = logger
+		}
+	}
+}
+
+// WithTargetSchemes sets the URL schemes allowed for targets of the admin API and the default storage (see storage.ValidateTarget).
+// A storage passed with WithRedirector needs the same schemes (e.g. storage.MapRedirect.SetTargetSchemes).
+func WithTargetSchemes(schemes []string) Option {
+	return func(s *Server) { s.targetSchemes = schemes }
+}
+
+// WithFallback sets a target for all requests without redirect (instead of 404 Not Found).
+// It is used after all redirects and default targets of the storage, code 0 uses storage.DefaultCode.
+func WithFallback(target string, code int) Option {
+	return func(s *Server) {
+		s.fallback = target
+		s.fallbackCode = code
+	}
+}
+
+// WithStats allows to pass hit counters, e.g. loaded from a file
+func WithStats(stats *storage.Stats) Option {
+	return func(s *Server) { s.stats = stats }
+}
+
+// WithAccessLog allows to write all redirect requests to an access log
+func WithAccessLog(accessLog *AccessLog) Option {
+	return func(s *Server) { s.accessLog = accessLog }
 }
 
 //WithMux allows to pass a custom mux
@@ -84,39 +232,118 @@ func WithRedirector(redirector storage.Redirector) Option {
 
 // Handler for http.HandleFunc for redirects
 func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
-	target, err := s.Redirector.GetTarget(r.Host, r.URL.Path)
+	start := time.Now()
+	outcome := outcomeRedirected
+	status, target := http.StatusNotFound, ""
+	defer func() {
+		duration := time.Since(start)
+		s.metrics.requestsTotal.Inc(outcome)
+		s.metrics.requestDuration.Observe(duration.Seconds(), outcome)
+		if s.accessLog != nil {
+			logged := s.accessLog.log(accessEntry{
+				Time: start, Remote: r.RemoteAddr, Method: r.Method, Host: r.Host, Path: r.RequestURI, Proto: r.Proto,
+				Status: status, Target: target, Duration: duration.Seconds(), Referer: r.Referer(), UserAgent: r.UserAgent(),
+			})
+			if !logged {
+				s.metrics.accessLogDropped.Inc()
+			}
+		}
+	}()
+
+	url := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+
+	settings := storage.SettingsFor(s.Redirector, r.Host)
+	https := s.isHTTPS(r)
+	if !https && settings.HTTPS {
+		outcome, status, target = outcomeHTTPSUpgrade, http.StatusMovedPermanently, s.httpsURL(r)
+		http.Redirect(w, r, target, status)
+		if s.accessLog == nil {
+			s.logger.WithFields(log.Fields{"host": r.Host, "url": url, "target": target}).Info("request upgraded to HTTPS")
+		}
+		return
+	}
+	if hsts := settings.HSTSHeader(); https && hsts != "" {
+		w.Header().Set("Strict-Transport-Security", hsts)
+	}
+
+	redirect, err := s.Redirector.GetTarget(r.Host, url)
+	// a rule expanding to an invalid target is answered with 404 Not Found, the request must not leave for the fallback either
+	if _, invalid := err.(*storage.TargetError); err != nil && !invalid && s.fallback != "" {
+		redirect, err = storage.Redirect{Target: s.fallback, Code: s.fallbackCode}, nil
+		outcome = outcomeFallback
+	}
 	if err != nil {
+		outcome = outcomeNotFound
 		http.NotFound(w, r)
-		log.Printf("no redirect found: %v", err)
+		if s.accessLog == nil {
+			s.logger.WithFields(log.Fields{"host": r.Host, "url": url}).Info("no redirect found")
+		}
 		return
 	}
-	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
-	log.Printf("request received for host %v and url %v, redirected to %v", r.Host, r.URL, target)
-
+	status, target = redirect.StatusCode(), redirect.Target
+	http.Redirect(w, r, target, status)
+	s.stats.Hit(redirect.Hostname, redirect.URL, time.Now())
+	if s.accessLog == nil {
+		s.logger.WithFields(log.Fields{"host": r.Host, "url": url, "target": target, "code": status}).Info("request redirected")
+	}
 }
 
-// AdminAPI is the http.Handler for API
+// AdminAPI is the http.Handler for the legacy API (see APIv2 for the resource-style API)
 // API supports following GET functions
 //
+//   /metrics - all metrics in the Prometheus text format (plain text, not JSON)
 //   /redirects/ping - only receive status ok
 //   /redirects/list - list all redirects
-//   /redirects/list?host=x - list all redirects for host x
+//   /redirects/list?host=x - list all redirects for host x (x can be a wildcard host like *.example.com)
 //   /redirects/list?host=x&url=y - show redirect for host x with url y
 //   /redirects/add?host=x&url=y&target=z - add or change redirect for host x with url y to target z
+//                                          (url y can be a prefix rule like /docs/*, the rest of the path is appended to z)
+//                                          (url y can be a regular expression starting with ~, $1 in z is replaced by the first submatch)
+//   /redirects/add?host=x&url=y&target=z&code=c - add or change redirect with HTTP status code c (301, 302, 303, 307 or 308; default 307)
+//   /redirects/add?host=x&url=y&target=z&priority=p - add or change regular expression rule with priority p (higher priorities are matched first)
+//   /redirects/add?host=x&url=y&target=z&query=q - add or change redirect with query policy q (drop, pass, merge or override)
+//                                                  (url y can contain a query like /search?lang=en, it matches requests with these parameters)
+//   /redirects/add?host=x&url=y&target=z&validFrom=t1&validUntil=t2 - add or change redirect which is only used from t1 until t2 (RFC 3339, e.g. 2018-06-01T12:00:00Z)
+//   /redirects/add?host=x&url=y&target=z&schedule=t1=z1&schedule=t2=z2 - add or change redirect which uses target z1 from t1 on and z2 from t2 on
+//   /redirects/shorten?host=x&target=z - create a short URL on host x for target z with a generated code, or return an existing one
+//   /redirects/shorten?host=x&target=z&short=s&code=c - create the short URL with code s (letters, digits, - and _) and HTTP status code c
 //   /redirects/delete?host=x&url=y - delete redirect for host x and url y
-//   /redirects/deleteHost?host=x - delete all redirects for host x
+//   /redirects/deleteHost?host=x - delete all redirects and settings for host x
+//   /redirects/hosts - list the settings of all hosts with settings
+//   /redirects/hosts?host=x - show the settings of host x
+//   /redirects/setHost?host=x&query=q - set the query policy q for all redirects of host x without own policy
+//   /redirects/setHost?host=x&default=z&defaultCode=c - set the default target z for all URLs of host x without redirect
+//                                                      (host * applies to all hosts, settings which are not given are kept)
+//   /redirects/setHost?host=x&ignoreCase=true&trailingSlash=true - match paths of host x case-insensitive and with or without trailing slash
+//   /redirects/setHost?host=x&https=true - redirect plain HTTP requests for host x to HTTPS (301) before any redirect applies
+//   /redirects/setHost?host=x&hstsMaxAge=n&hstsIncludeSubDomains=true&hstsPreload=true - send a Strict-Transport-Security header
+//                                                                                       with max-age n on HTTPS responses for host x
+//   /redirects/stats - list the hit counters of all redirects, most hits first
+//   /redirects/stats?host=x&url=y - list the hit counters of host x (and url y; the url of a default target is empty)
+//   /redirects/stats?top=n&from=d1&to=d2 - list the n redirects with most hits from day d1 until day d2 (2006-01-02, UTC)
+//
+// Hostnames and URLs are normalized (lowercase hostname without trailing dot and default port, punycode, canonical percent-encoding)
+//
+// With API keys (see WithKeys) all functions except ping require a key with read access, add, shorten, delete, deleteHost and setHost a key
+// with write access. Requests without host (e.g. list of all redirects) are not allowed for keys limited to hostnames.
 //
 // add, delete and deleteHost reply with a status
 //   Status: true iftrue
 //   Message: additional information
 //   Content: []Redirect
+//   Hosts: []HostSettings (only for hosts and setHost)
+//   Stats: []HitCount (only for stats)
 func (s *Server) AdminAPI(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.NotFound(w, r)
 		return
 	}
 
-	log.Debugf("received request %v", r)
+	s.logger.WithFields(log.Fields{"remote": r.RemoteAddr, "url": r.URL.String()}).Debug("received admin request")
+	s.metrics.requestsTotal.Inc(outcomeAdmin)
 
 	red := s.Redirector
 
@@ -144,52 +371,230 @@ func (s *Server) AdminAPI(w http.ResponseWriter, r *http.Request) {
 		target = targets[0]
 	}
 
+	query := ""
+	if queries := params["query"]; len(queries) > 0 {
+		query = queries[0]
+	}
+
+	code, codeErr := intParam(params, "code")
+	priority, priorityErr := intParam(params, "priority")
+	defaultCode, defaultCodeErr := intParam(params, "defaultCode")
+	ignoreCase, ignoreCaseErr := boolParam(params, "ignoreCase")
+	trailingSlash, trailingSlashErr := boolParam(params, "trailingSlash")
+	https, httpsErr := boolParam(params, "https")
+	hstsMaxAge, hstsMaxAgeErr := intParam(params, "hstsMaxAge")
+	hstsIncludeSubDomains, hstsIncludeSubDomainsErr := boolParam(params, "hstsIncludeSubDomains")
+	hstsPreload, hstsPreloadErr := boolParam(params, "hstsPreload")
+	validFrom, validFromErr := timeParam(params, "validFrom")
+	validUntil, validUntilErr := timeParam(params, "validUntil")
+	schedule, scheduleErr := scheduleParam(params, "schedule")
+	top, topErr := intParam(params, "top")
+	from, fromErr := dateParam(params, "from")
+	to, toErr := dateParam(params, "to")
+	malformed := codeErr != nil || priorityErr != nil || defaultCodeErr != nil || ignoreCaseErr != nil || trailingSlashErr != nil ||
+		httpsErr != nil || hstsMaxAgeErr != nil || hstsIncludeSubDomainsErr != nil || hstsPreloadErr != nil ||
+		validFromErr != nil || validUntilErr != nil || scheduleErr != nil || topErr != nil || fromErr != nil || toErr != nil
+
 	var response responseStatus
 
-	log.Debugf("parsed request %v %v %v %v", function, host, url, target)
+	s.logger.WithFields(log.Fields{
+		"function": function, "host": host, "url": url, "target": target, "code": code, "priority": priority, "query": query,
+	}).Debug("parsed admin request")
+
+	if function != "ping" {
+		write := function == "add" || function == "delete" || function == "deleteHost" || function == "setHost" || function == "shorten"
+		if status, message := s.authorize(w, r, write, host); status != 0 {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(responseStatus{false, message, nil, nil, nil})
+			return
+		}
+	}
 
 	switch function {
 	case "ping":
-		response = responseStatus{true, "pong", nil}
+		response = responseStatus{true, "pong", nil, nil, nil}
 	case "list":
 		if host == "" {
-			response = responseStatus{true, "all redirects", red.GetAllRedirects()}
+			response = responseStatus{true, "all redirects", red.GetAllRedirects(), nil, nil}
 		} else if url == "" {
-			response = responseStatus{true, "redirects for host", red.GetRedirectsForHost(host)}
+			response = responseStatus{true, "redirects for host", red.GetRedirectsForHost(host), nil, nil}
 		} else {
-			response = responseStatus{true, "redirects for host and url", red.GetRedirect(host, url)}
+			response = responseStatus{true, "redirects for host and url", red.GetRedirect(host, url), nil, nil}
 		}
 	case "add":
-		if host == "" || url == "" || target == "" {
-			response = responseStatus{false, "request malformed", nil}
+		if host == "" || url == "" || target == "" || malformed {
+			response = responseStatus{false, "request malformed", nil, nil, nil}
 		} else {
-			err := red.AddRedirect(storage.Redirect{host, url, target})
+			err := red.AddRedirect(storage.Redirect{
+				Hostname: host, URL: url, Target: target, Code: code, Priority: priority, Query: query,
+				ValidFrom: validFrom, ValidUntil: validUntil, Schedule: schedule,
+			})
 			if err != nil {
-				response = responseStatus{false, err.Error(), nil}
+				response = responseStatus{false, err.Error(), nil, nil, nil}
 			} else {
-				response = responseStatus{true, "redirect added", red.GetRedirect(host, url)}
+				response = responseStatus{true, "redirect added", red.GetRedirect(host, url), nil, nil}
+			}
+		}
+	case "shorten":
+		if host == "" || target == "" || malformed {
+			response = responseStatus{false, "request malformed", nil, nil, nil}
+		} else {
+			redirect, created, err := s.shortener.Shorten(red, storage.ShortenRequest{Hostname: host, Target: target, Short: params.Get("short"), Code: code})
+			switch {
+			case err != nil:
+				response = responseStatus{false, err.Error(), nil, nil, nil}
+			case created:
+				response = responseStatus{true, "short URL " + s.shortURL(redirect) + " created", []storage.Redirect{redirect}, nil, nil}
+			default:
+				response = responseStatus{true, "short URL " + s.shortURL(redirect) + " exists", []storage.Redirect{redirect}, nil, nil}
 			}
 		}
 	case "delete":
 		if host == "" || url == "" {
-			response = responseStatus{false, "request malformed", nil}
+			response = responseStatus{false, "request malformed", nil, nil, nil}
 		} else {
-			red.RemoveRedirect(storage.Redirect{host, url, ""})
-			response = responseStatus{true, "redirect deleted", nil}
+			red.RemoveRedirect(storage.Redirect{Hostname: host, URL: url})
+			response = responseStatus{true, "redirect deleted", nil, nil, nil}
 		}
 	case "deleteHost":
 		if host == "" {
-			response = responseStatus{false, "request malformed", nil}
+			response = responseStatus{false, "request malformed", nil, nil, nil}
 		} else {
-			red.RemoveAllRedirectsForHost(storage.Redirect{host, "", ""})
-			response = responseStatus{true, "host deleted", nil}
+			red.RemoveAllRedirectsForHost(storage.Redirect{Hostname: host})
+			response = responseStatus{true, "host deleted", nil, nil, nil}
+		}
+	case "hosts":
+		if host == "" {
+			response = responseStatus{true, "all host settings", nil, red.GetAllHostSettings(), nil}
+		} else {
+			response = responseStatus{true, "settings for host", nil, []storage.HostSettings{red.GetHostSettings(host)}, nil}
+		}
+	case "setHost":
+		if host == "" || malformed {
+			response = responseStatus{false, "request malformed", nil, nil, nil}
+		} else {
+			settings := red.GetHostSettings(host)
+			if _, ok := params["query"]; ok {
+				settings.Query = query
+			}
+			if _, ok := params["default"]; ok {
+				settings.Default = params.Get("default")
+			}
+			if _, ok := params["defaultCode"]; ok {
+				settings.DefaultCode = defaultCode
+			}
+			if settings.Default == "" {
+				settings.DefaultCode = 0
+			}
+			if _, ok := params["ignoreCase"]; ok {
+				settings.IgnoreCase = ignoreCase
+			}
+			if _, ok := params["trailingSlash"]; ok {
+				settings.TrailingSlash = trailingSlash
+			}
+			if _, ok := params["https"]; ok {
+				settings.HTTPS = https
+			}
+			if _, ok := params["hstsMaxAge"]; ok {
+				settings.HSTSMaxAge = hstsMaxAge
+			}
+			if _, ok := params["hstsIncludeSubDomains"]; ok {
+				settings.HSTSIncludeSubDomains = hstsIncludeSubDomains
+			}
+			if _, ok := params["hstsPreload"]; ok {
+				settings.HSTSPreload = hstsPreload
+			}
+			err := s.validateHTTPS(settings)
+			if err == nil {
+				err = red.SetHostSettings(settings)
+			}
+			if err != nil {
+				response = responseStatus{false, err.Error(), nil, nil, nil}
+			} else {
+				response = responseStatus{true, "host settings changed", nil, []storage.HostSettings{red.GetHostSettings(host)}, nil}
+			}
+		}
+	case "stats":
+		if malformed {
+			response = responseStatus{false, "request malformed", nil, nil, nil}
+		} else {
+			if host != "" {
+				host = storage.NormalizeHost(host)
+			}
+			if url != "" {
+				url = storage.NormalizeURL(url)
+			}
+			filter := storage.StatsFilter{Hostname: host, URL: url, From: from, To: to, Top: top}
+			response = responseStatus{true, "hit counters", nil, nil, s.stats.Get(filter)}
 		}
 	default:
 		http.NotFound(w, r)
 		return
 	}
 
-	log.Debugf("sending response %v", response)
+	switch function {
+	case "add", "delete", "deleteHost", "setHost", "shorten":
+		s.metrics.adminMutations.Inc(function, result(response.Status))
+	}
+
+	s.logger.WithFields(log.Fields{"function": function, "status": response.Status, "message": response.Message}).Debug("sending admin response")
 	json.NewEncoder(w).Encode(response)
 
 }
+
+// intParam returns the first value of an integer query parameter, 0 if it is not set
+func intParam(params url.Values, name string) (int, error) {
+	values := params[name]
+	if len(values) == 0 || values[0] == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(values[0])
+}
+
+// boolParam returns the first value of a boolean query parameter, false if it is not set
+func boolParam(params url.Values, name string) (bool, error) {
+	values := params[name]
+	if len(values) == 0 || values[0] == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(values[0])
+}
+
+// timeParam returns the first value of a time query parameter (RFC 3339), nil if it is not set
+func timeParam(params url.Values, name string) (*time.Time, error) {
+	values := params[name]
+	if len(values) == 0 || values[0] == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, values[0])
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// scheduleParam returns all values of a schedule query parameter, every value is time=target (time in RFC 3339)
+func scheduleParam(params url.Values, name string) ([]storage.ScheduledTarget, error) {
+	var schedule []storage.ScheduledTarget
+	for _, value := range params[name] {
+		i := strings.IndexByte(value, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid schedule %v, expected time=target", value)
+		}
+		from, err := time.Parse(time.RFC3339, value[:i])
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, storage.ScheduledTarget{From: from, Target: value[i+1:]})
+	}
+	return schedule, nil
+}
+
+// dateParam returns the first value of a date query parameter (2006-01-02), the zero time if it is not set
+func dateParam(params url.Values, name string) (time.Time, error) {
+	values := params[name]
+	if len(values) == 0 || values[0] == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", values[0])
+}
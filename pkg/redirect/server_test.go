@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flo80/redirect/pkg/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminHost is the hostname of the admin API of test servers
+const adminHost = "admin.test"
+
+// quietLogger returns a logger discarding all output
+func quietLogger() *log.Logger {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// newTestServer returns a server with its own mux and the admin API on adminHost, which does not log
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	logger := quietLogger()
+	opts = append([]Option{WithMux(http.NewServeMux()), WithLogger(logger), WithAdmin(adminHost)}, opts...)
+	return NewServer(":0", opts...)
+}
+
+// newKeyStore returns an empty key store in a temporary directory
+func newKeyStore(t *testing.T) *auth.KeyStore {
+	t.Helper()
+	keys, err := auth.OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// addKey adds a key to keys and returns its token
+func addKey(t *testing.T, keys *auth.KeyStore, scope string, hosts ...string) string {
+	t.Helper()
+	token, _, err := keys.Add("test", scope, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve sends a request to the mux of s, with token as bearer token unless it is empty
+func serve(s *Server, method, url, body, token string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, url, reader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w
+}
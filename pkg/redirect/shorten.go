@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// shortened is the response of the v2 admin API for shorten requests
+type shortened struct {
+	storage.Redirect
+	ShortURL string // URL to share, e.g. https://example.com/abc123
+}
+
+// WithShortener uses shortener to create short URLs (see storage.NewShortener for the defaults)
+func WithShortener(shortener *storage.Shortener) Option {
+	return func(s *Server) {
+		if shortener != nil {
+			s.shortener = shortener
+		}
+	}
+}
+
+// defaultShortener returns a shortener with the default alphabet, length and reserved codes
+func defaultShortener() *storage.Shortener {
+	shortener, err := storage.NewShortener("", 0, nil)
+	if err != nil {
+		panic(err) // the defaults are valid
+	}
+	return shortener
+}
+
+// shortURL returns the URL of a short redirect, with HTTPS if the hostname is upgraded to HTTPS
+func (s *Server) shortURL(redirect storage.Redirect) string {
+	scheme := "http"
+	if storage.SettingsFor(s.Redirector, redirect.Hostname).HTTPS {
+		scheme = "https"
+	}
+	return scheme + "://" + redirect.Hostname + redirect.URL
+}
+
+// apiV2Shorten handles /api/v2/hosts/{host}/shorten, the body is a storage.ShortenRequest
+func (s *Server) apiV2Shorten(w http.ResponseWriter, r *http.Request, host string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req storage.ShortenRequest
+	if !s.readJSON(w, r, &req) {
+		s.metrics.adminMutations.Inc("shorten", result(false))
+		return
+	}
+	if req.Hostname != "" && storage.NormalizeHost(req.Hostname) != storage.NormalizeHost(host) {
+		s.metrics.adminMutations.Inc("shorten", result(false))
+		s.writeError(w, http.StatusBadRequest, errInvalidShort, fmt.Sprintf("hostname %v does not match path", req.Hostname))
+		return
+	}
+	req.Hostname = host
+	if err := s.shortener.Validate(req, s.targetSchemes...); err != nil {
+		s.metrics.adminMutations.Inc("shorten", result(false))
+		s.writeError(w, http.StatusBadRequest, errInvalidShort, err.Error())
+		return
+	}
+
+	redirect, created, err := s.shortener.Shorten(s.Redirector, req)
+	if err != nil {
+		s.metrics.adminMutations.Inc("shorten", result(false))
+		s.writeStorageError(w, err, errInvalidShort)
+		return
+	}
+	s.metrics.adminMutations.Inc("shorten", result(true))
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", redirectLocation(redirect))
+	}
+	s.writeJSON(w, status, shortened{redirect, s.shortURL(redirect)})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAPIv2Shorten(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	s := newTestServer(t, WithTrustedProxies([]*net.IPNet{proxies}))
+	runSteps(t, s, "", []apiStep{
+		{"PUT", "hosts/secure.com", `{"HTTPS": true}`, 201, ""},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/a", "Short": "docs"}`, 201, ""},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/a", "Short": "docs"}`, 200, ""},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/b", "Short": "docs"}`, 409, errConflict},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/a", "Short": "admin"}`, 400, errInvalidShort},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/a", "Short": "a/b"}`, 400, errInvalidShort},
+		{"POST", "hosts/example.com/shorten", `{"Target": "https://example.org/a", "Hostname": "other.com"}`, 400, errInvalidShort},
+		{"POST", "hosts/example.com/shorten", `{"Target": "javascript:alert(1)"}`, 400, errInvalidShort},
+		{"GET", "hosts/example.com/shorten", "", 405, errMethodNotAllowed},
+	})
+
+	tests := []struct {
+		host    string
+		status  int
+		pattern string // scheme and hostname of the short URL
+	}{
+		{"example.com", 201, "http://example.com/"},
+		{"example.com", 200, "http://example.com/"},
+		{"secure.com", 201, "https://secure.com/"},
+	}
+	var first shortened
+	for i, tt := range tests {
+		w := serve(s, "POST", "http://"+adminHost+apiV2Prefix+"hosts/"+tt.host+"/shorten", `{"Target": "https://example.org/generated"}`, "")
+		var got shortened
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != tt.status {
+			t.Fatalf("shorten for %v returns %v: %v", tt.host, w.Code, w.Body)
+		}
+		if got.ShortURL != tt.pattern+strings.TrimPrefix(got.URL, "/") {
+			t.Errorf("short URL %v of %v does not start with %v", got.ShortURL, got.URL, tt.pattern)
+		}
+		if tt.status == 201 && w.Header().Get("Location") == "" {
+			t.Errorf("created short URL has no Location")
+		}
+		// the same target of the host gets the same short URL
+		if i == 0 {
+			first = got
+		} else if tt.host == first.Hostname && got.URL != first.URL {
+			t.Errorf("second short URL %v differs from %v", got.URL, first.URL)
+		}
+	}
+}
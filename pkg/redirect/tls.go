@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/flo80/redirect/pkg/certs"
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// WithTLS serves redirects (and the admin API on the admin host) also with HTTPS on address, e.g. ":443".
+// The certificate of a request is selected by its hostname (SNI) from store, the admin API can manage the certificates of store.
+func WithTLS(address string, store *certs.Store) Option {
+	return func(s *Server) {
+		s.certs = store
+		s.tlsServer = &http.Server{
+			Addr: address,
+			TLSConfig: &tls.Config{
+				GetCertificate: store.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+			},
+		}
+	}
+}
+
+// WithTrustedProxies trusts the X-Forwarded-Proto header of requests from networks, e.g. of a load balancer terminating TLS.
+// Requests of a trusted proxy with X-Forwarded-Proto https are treated as HTTPS requests: they are not upgraded and get the HSTS header.
+func WithTrustedProxies(networks []*net.IPNet) Option {
+	return func(s *Server) { s.trustedProxies = networks }
+}
+
+// isHTTPS returns true if request r was received with HTTPS, by the HTTPS listener or by a trusted proxy (see WithTrustedProxies)
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 || !s.trustedProxy(r.RemoteAddr) {
+		return false
+	}
+	// a proxy appends its value, only the last one is set by the trusted proxy
+	protos := strings.Split(values[len(values)-1], ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+// trustedProxy returns true if remoteAddr (ip:port) is in one of the networks of WithTrustedProxies
+func (s *Server) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range s.trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHTTPS refuses to upgrade a hostname to HTTPS if the server receives no HTTPS requests (see WithTLS and WithTrustedProxies),
+// e.g. behind a proxy terminating TLS the upgraded requests would arrive as plain HTTP again and be redirected to themselves
+func (s *Server) validateHTTPS(settings storage.HostSettings) error {
+	if settings.HTTPS && s.tlsServer == nil && len(s.trustedProxies) == 0 {
+		return fmt.Errorf("HTTPS upgrade of %v requires an HTTPS listener or a trusted proxy terminating TLS", settings.Hostname)
+	}
+	return nil
+}
+
+// httpsURL returns the URL of request r with HTTPS, using the port of the HTTPS listener (none for 443 or without HTTPS listener)
+func (s *Server) httpsURL(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	port := "443"
+	if s.tlsServer != nil {
+		if _, p, err := net.SplitHostPort(s.tlsServer.Addr); err == nil && p != "" {
+			port = p
+		}
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 address
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// apiV2Certificates handles /api/v2/certificates and /api/v2/certificates/{name}, name is certs.DefaultName or a hostname
+func (s *Server) apiV2Certificates(w http.ResponseWriter, r *http.Request, segments []string) {
+	if s.certs == nil {
+		s.writeError(w, http.StatusNotFound, errNotFound, "HTTPS is not enabled")
+		return
+	}
+
+	name := ""
+	if len(segments) > 1 {
+		var err error
+		if name, err = url.PathUnescape(segments[1]); err != nil || len(segments) > 2 {
+			s.writeError(w, http.StatusNotFound, errNotFound, "unknown resource")
+			return
+		}
+	}
+
+	// the default certificate is used for all hostnames
+	host := name
+	if name == certs.DefaultName {
+		host = ""
+	}
+	if status, message := s.authorize(w, r, r.Method != http.MethodGet, host); status != 0 {
+		s.writeAuthError(w, status, message)
+		return
+	}
+
+	if name == "" {
+		if allowMethods(w, r, http.MethodGet) {
+			s.writeJSON(w, http.StatusOK, s.certs.List())
+		}
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, cert := range s.certs.List() {
+			if cert.Name != "" && strings.EqualFold(cert.Name, name) {
+				s.writeJSON(w, http.StatusOK, cert)
+				return
+			}
+		}
+		s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("no certificate %v", name))
+
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			s.metrics.adminMutations.Inc("putCertificate", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidBody, fmt.Sprintf("invalid body: %v", err))
+			return
+		}
+		// the certificate is used for all its hostnames, not only for name
+		cert, err := s.certs.Put(name, data, s.allowedHosts(r))
+		if _, notAllowed := err.(*certs.NotAllowedError); notAllowed {
+			s.metrics.adminMutations.Inc("putCertificate", result(false))
+			s.writeAuthError(w, http.StatusForbidden, fmt.Sprintf("API key does not allow this request: %v", err))
+			return
+		} else if err != nil {
+			s.metrics.adminMutations.Inc("putCertificate", result(false))
+			s.writeError(w, http.StatusBadRequest, errInvalidCertificate, err.Error())
+			return
+		}
+		s.metrics.adminMutations.Inc("putCertificate", result(true))
+		s.writeJSON(w, http.StatusOK, cert)
+
+	case http.MethodDelete:
+		// the certificate is removed for all its hostnames, not only for name
+		err := s.certs.Remove(name, s.allowedHosts(r))
+		if _, notAllowed := err.(*certs.NotAllowedError); notAllowed {
+			s.metrics.adminMutations.Inc("deleteCertificate", result(false))
+			s.writeAuthError(w, http.StatusForbidden, fmt.Sprintf("API key does not allow this request: %v", err))
+			return
+		} else if err == certs.ErrNotFound {
+			s.writeError(w, http.StatusNotFound, errNotFound, fmt.Sprintf("no certificate %v", name))
+			return
+		} else if err != nil {
+			s.metrics.adminMutations.Inc("deleteCertificate", result(false))
+			s.writeError(w, http.StatusInternalServerError, errStorage, err.Error())
+			return
+		}
+		s.metrics.adminMutations.Inc("deleteCertificate", result(true))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
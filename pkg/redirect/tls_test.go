@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flo80/redirect/pkg/auth"
+	"github.com/flo80/redirect/pkg/certs"
+	"github.com/flo80/redirect/pkg/storage"
+)
+
+// pemCertificate returns PEM data of a self-signed certificate for hostnames and its private key
+func pemCertificate(t *testing.T, hostnames ...string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostnames[0]},
+		DNSNames:     hostnames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return b.String()
+}
+
+func TestCertificateScope(t *testing.T) {
+	store, err := certs.NewStore(t.TempDir(), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Put("shared.example.com", []byte(pemCertificate(t, "shared.example.com", "other.org")), nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := newKeyStore(t)
+	scoped := addKey(t, keys, auth.ScopeWrite, "*.example.com")
+	reader := addKey(t, keys, auth.ScopeRead)
+	s := newTestServer(t, WithKeys(keys), WithTLS(":0", store))
+
+	const certificates = "http://" + adminHost + "/api/v2/certificates/"
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		hostnames []string // hostnames of the certificate of the body, none for no body
+		token     string
+		status    int
+	}{
+		{"put with own hostnames", "PUT", certificates + "www.example.com", []string{"www.example.com"}, scoped, 200},
+		{"put with other hostname", "PUT", certificates + "www.example.com", []string{"www.example.com", "other.org"}, scoped, 403},
+		{"put for other hostname", "PUT", certificates + "other.org", []string{"other.org"}, scoped, 403},
+		{"put without key", "PUT", certificates + "www.example.com", []string{"www.example.com"}, "", 401},
+		{"put with read key", "PUT", certificates + "www.example.com", []string{"www.example.com"}, reader, 403},
+		{"put not covering name", "PUT", certificates + "api.example.com", []string{"www.example.com"}, scoped, 400},
+		// the stored certificate is also valid for other.org, replacing or deleting it would drop it there
+		{"replace certificate with other hostname", "PUT", certificates + "shared.example.com", []string{"shared.example.com"}, scoped, 403},
+		{"delete certificate with other hostname", "DELETE", certificates + "shared.example.com", nil, scoped, 403},
+		{"delete own certificate", "DELETE", certificates + "www.example.com", nil, scoped, 204},
+		{"delete missing certificate", "DELETE", certificates + "www.example.com", nil, scoped, 404},
+		{"get with read key", "GET", certificates + "shared.example.com", nil, reader, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.hostnames != nil {
+				body = pemCertificate(t, tt.hostnames...)
+			}
+			if w := serve(s, tt.method, tt.url, body, tt.token); w.Code != tt.status {
+				t.Errorf("%v %v returns %v, expected %v: %v", tt.method, tt.url, w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	if len(store.List()) != 1 {
+		t.Errorf("certificates after the requests are %v, expected only shared.example.com", store.List())
+	}
+}
+
+func TestHTTPSUpgrade(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	red := storage.NewMapRedirect(quietLogger())
+	red.AddRedirect(storage.Redirect{Hostname: "example.com", URL: "/a", Target: "https://example.org/a"})
+	red.AddRedirect(storage.Redirect{Hostname: "plain.com", URL: "/a", Target: "https://example.org/a"})
+	red.SetHostSettings(storage.HostSettings{Hostname: "example.com", HTTPS: true, HSTSMaxAge: storage.HSTSPreloadMinAge, HSTSIncludeSubDomains: true, HSTSPreload: true})
+	s := newTestServer(t, WithRedirector(red), WithTrustedProxies([]*net.IPNet{proxies}))
+
+	const hsts = "max-age=31536000; includeSubDomains; preload"
+	tests := []struct {
+		name     string
+		url      string
+		remote   string
+		tls      bool
+		forwards []string // X-Forwarded-Proto headers
+		status   int
+		location string
+		hsts     string
+	}{
+		{"plain request is upgraded", "http://example.com/a?x=1", "192.0.2.1:1234", false, nil, 301, "https://example.com/a?x=1", ""},
+		{"port of plain request is dropped", "http://example.com:8080/a", "192.0.2.1:1234", false, nil, 301, "https://example.com/a", ""},
+		{"HTTPS request gets HSTS", "https://example.com/a", "192.0.2.1:1234", true, nil, 307, "https://example.org/a", hsts},
+		{"header of untrusted client is ignored", "http://example.com/a", "192.0.2.1:1234", false, []string{"https"}, 301, "https://example.com/a", ""},
+		{"trusted proxy with https", "http://example.com/a", "10.1.2.3:1234", false, []string{"https"}, 307, "https://example.org/a", hsts},
+		{"trusted proxy with http", "http://example.com/a", "10.1.2.3:1234", false, []string{"http"}, 301, "https://example.com/a", ""},
+		{"only the value of the trusted proxy counts", "http://example.com/a", "10.1.2.3:1234", false, []string{"https, http"}, 301, "https://example.com/a", ""},
+		{"last header counts", "http://example.com/a", "10.1.2.3:1234", false, []string{"http", "https"}, 307, "https://example.org/a", hsts},
+		{"no settings", "http://plain.com/a", "192.0.2.1:1234", false, nil, 307, "https://example.org/a", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			r.RemoteAddr = tt.remote
+			if !tt.tls {
+				r.TLS = nil
+			} else if r.TLS == nil {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for _, proto := range tt.forwards {
+				r.Header.Add("X-Forwarded-Proto", proto)
+			}
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+				t.Errorf("got %v to %v, expected %v to %v", w.Code, w.Header().Get("Location"), tt.status, tt.location)
+			}
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.hsts {
+				t.Errorf("HSTS header is %q, expected %q", got, tt.hsts)
+			}
+		})
+	}
+}
+
+func TestHTTPSURL(t *testing.T) {
+	store, err := certs.NewStore(t.TempDir(), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tlsAddress string // empty for no HTTPS listener
+		url        string
+		want       string
+	}{
+		{"", "http://example.com:8080/a?b=c", "https://example.com/a?b=c"},
+		{":443", "http://example.com/a", "https://example.com/a"},
+		{":8443", "http://example.com:8080/a", "https://example.com:8443/a"},
+		{"", "http://[2001:db8::1]:8080/a", "https://[2001:db8::1]/a"},
+		{":8443", "http://[2001:db8::1]/a", "https://[2001:db8::1]:8443/a"},
+	}
+	for _, tt := range tests {
+		var opts []Option
+		if tt.tlsAddress != "" {
+			opts = append(opts, WithTLS(tt.tlsAddress, store))
+		}
+		s := newTestServer(t, opts...)
+		if got := s.httpsURL(httptest.NewRequest("GET", tt.url, nil)); got != tt.want {
+			t.Errorf("HTTPS URL of %v with listener %q is %v, expected %v", tt.url, tt.tlsAddress, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPSSettings(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	runSteps(t, newTestServer(t), "", []apiStep{
+		// without HTTPS listener and trusted proxy upgraded requests would be upgraded again
+		{"PUT", "hosts/example.com", `{"HTTPS": true}`, 400, errInvalidSettings},
+		{"PUT", "hosts/example.com", `{"HSTSMaxAge": 3600}`, 201, ""},
+	})
+	runSteps(t, newTestServer(t, WithTrustedProxies([]*net.IPNet{proxies})), "", []apiStep{
+		{"PUT", "hosts/example.com", `{"HTTPS": true}`, 201, ""},
+		{"PUT", "hosts/example.com", `{"HSTSMaxAge": -1}`, 400, errInvalidSettings},
+		{"PUT", "hosts/example.com", `{"HSTSIncludeSubDomains": true}`, 400, errInvalidSettings},
+		{"PUT", "hosts/example.com", `{"HSTSMaxAge": 3600, "HSTSIncludeSubDomains": true, "HSTSPreload": true}`, 400, errInvalidSettings},
+		{"PUT", "hosts/example.com", `{"HTTPS": true, "HSTSMaxAge": 31536000, "HSTSIncludeSubDomains": true, "HSTSPreload": true}`, 200, ""},
+	})
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flo80/redirect/pkg/metrics"
+)
+
+// backups of a file are named <file>.<timestamp>.bak, the timestamp sorts chronologically
+const (
+	backupTimeFormat = "20060102T150405.000Z"
+	backupSuffix     = ".bak"
+)
+
+// SaveFile replaces filename with data atomically (a crash leaves either the old or the new file).
+// If backups > 0, the previous content of filename is kept as timestamped backup next to it,
+// only the newest backups are retained. If the content did not change, nothing is written.
+func SaveFile(filename string, data []byte, backups int) error {
+	old, err := ioutil.ReadFile(filename)
+	switch {
+	case err == nil && bytes.Equal(old, data):
+		return nil
+	case err == nil && backups > 0:
+		backup := fmt.Sprintf("%v.%v%v", filename, time.Now().UTC().Format(backupTimeFormat), backupSuffix)
+		if err = WriteFileAtomic(backup, old, 0644); err != nil {
+			return fmt.Errorf("could not write backup %v: %v", backup, err)
+		}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	if err = WriteFileAtomic(filename, data, 0644); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		return pruneBackups(filename, backups)
+	}
+	return nil
+}
+
+// Backups lists the backup files of filename, newest first
+func Backups(filename string) ([]string, error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, base+".") || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), backupSuffix)
+		if _, err := time.Parse(backupTimeFormat, timestamp); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// ReadBackup returns the content of a backup of filename, backup is the name of the backup file (with or without directory)
+func ReadBackup(filename, backup string) ([]byte, error) {
+	backups, err := Backups(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range backups {
+		if filepath.Base(b) == filepath.Base(backup) {
+			return ioutil.ReadFile(b)
+		}
+	}
+	return nil, fmt.Errorf("backup %v of %v not found", backup, filename)
+}
+
+// pruneBackups removes all but the newest keep backups of filename
+func pruneBackups(filename string, keep int) error {
+	backups, err := Backups(filename)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > keep {
+		old := backups[len(backups)-1]
+		if err := os.Remove(old); err != nil {
+			return fmt.Errorf("could not remove backup %v: %v", old, err)
+		}
+		backups = backups[:len(backups)-1]
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to filename and renames it to filename
+// once the data is on disk. Readers (and a restart after a crash) therefore either see the old or
+// the new content of filename, but never a partially written file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after successful rename
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory to disk so a preceding rename survives a crash.
+// This is best effort, not all platforms support syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// SaveMetrics counts the saves of files (save file, snapshot, hit counters) and their duration.
+// A nil SaveMetrics records nothing.
+type SaveMetrics struct {
+	total    *metrics.Counter
+	duration *metrics.Histogram
+}
+
+// NewSaveMetrics registers the metrics of saving files in registry, e.g. the registry of the server
+func NewSaveMetrics(registry *metrics.Registry) *SaveMetrics {
+	return &SaveMetrics{
+		total: registry.NewCounter("redirect_saves_total",
+			"Number of saves of files (save file, snapshot, hit counters) by file and result (success, failure).", "file", "result"),
+		duration: registry.NewHistogram("redirect_save_duration_seconds",
+			"Duration of saving files in seconds by file.", metrics.DefaultBuckets, "file"),
+	}
+}
+
+// SaveFile saves filename (see SaveFile) and records the result and duration
+func (m *SaveMetrics) SaveFile(filename string, data []byte, backups int) error {
+	start := time.Now()
+	err := SaveFile(filename, data, backups)
+	m.observe(filename, start, err)
+	return err
+}
+
+// observe records the result and duration of saving a file, which started at start
+func (m *SaveMetrics) observe(filename string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.total.Inc(filename, result)
+	m.duration.Observe(time.Since(start).Seconds(), filename)
+}
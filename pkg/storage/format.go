@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// FormatVersion is the version of the save file format written by EncodeFile
+//
+// Version history
+//
+//	0 - {"Hosts": {hostname: {url: target}}}, or only the map of hostnames (no Version field)
+//	1 - {"Version": 1, "Redirects": [{"Hostname": hostname, "URL": url, "Target": target}], "HostSettings": [{"Hostname": hostname}]}
+const FormatVersion = 1
+
+// saveFile is the save file in the current format version.
+// Every redirect is an object, so it can be extended with further settings without a new version,
+// as long as a missing field keeps the previous behaviour.
+type saveFile struct {
+	Version      int
+	Redirects    []Redirect
+	HostSettings []HostSettings `json:",omitempty"`
+}
+
+// migrations[v] converts a save file of version v to version v+1
+var migrations = []func([]byte) ([]byte, error){
+	migrateV0,
+}
+
+// EncodeFile returns the save file with all redirects and host settings in the current format version.
+// The redirects are sorted by hostname and URL, the settings by hostname, so the same redirects always result in the same file.
+func EncodeFile(redirects []Redirect, settings []HostSettings) ([]byte, error) {
+	sorted := make([]Redirect, len(redirects))
+	copy(sorted, redirects)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Hostname != sorted[j].Hostname {
+			return sorted[i].Hostname < sorted[j].Hostname
+		}
+		return sorted[i].URL < sorted[j].URL
+	})
+
+	sortedSettings := make([]HostSettings, len(settings))
+	copy(sortedSettings, settings)
+	sort.Slice(sortedSettings, func(i, j int) bool {
+		return sortedSettings[i].Hostname < sortedSettings[j].Hostname
+	})
+
+	return json.Marshal(saveFile{FormatVersion, sorted, sortedSettings})
+}
+
+// DecodeFile parses a save file of any known version, older versions are migrated to the current version.
+// version is the version of the file before migration. schemes are the URL schemes allowed for targets (see Redirect.Validate).
+func DecodeFile(b []byte, schemes ...string) (redirects []Redirect, settings []HostSettings, version int, err error) {
+	file, version, err := decodeFile(b)
+	if err != nil {
+		return nil, nil, version, err
+	}
+
+	for i, redirect := range file.Redirects {
+		if err = redirect.Validate(schemes...); err != nil {
+			return nil, nil, version, fmt.Errorf("redirect %v: %v", i+1, err)
+		}
+	}
+	for _, hostSettings := range file.HostSettings {
+		if err = hostSettings.Validate(schemes...); err != nil {
+			return nil, nil, version, fmt.Errorf("settings of host %v: %v", hostSettings.Hostname, err)
+		}
+	}
+	return file.Redirects, file.HostSettings, version, nil
+}
+
+// decodeFile parses and migrates a save file like DecodeFile, but does not validate redirects and settings
+func decodeFile(b []byte) (file saveFile, version int, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return saveFile{}, 0, err
+	}
+
+	if raw, ok := fields["Version"]; ok {
+		if err = json.Unmarshal(raw, &version); err != nil {
+			return saveFile{}, 0, fmt.Errorf("invalid version: %v", err)
+		}
+	}
+	if version < 0 || version > FormatVersion {
+		return saveFile{}, version, fmt.Errorf("unsupported version %v, latest known version is %v", version, FormatVersion)
+	}
+
+	for v := version; v < FormatVersion; v++ {
+		if b, err = migrations[v](b); err != nil {
+			return saveFile{}, version, fmt.Errorf("could not migrate from version %v: %v", v, err)
+		}
+	}
+
+	err = json.Unmarshal(b, &file)
+	return file, version, err
+}
+
+// migrateV0 converts {"Hosts": {hostname: {url: target}}} or {hostname: {url: target}} to version 1
+func migrateV0(b []byte) ([]byte, error) {
+	type redirectV1 struct {
+		Hostname string
+		URL      string
+		Target   string
+	}
+	type saveFileV1 struct {
+		Version   int
+		Redirects []redirectV1
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if hosts, ok := fields["Hosts"]; ok {
+		b = hosts
+	}
+
+	var hosts map[string]map[string]string
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, err
+	}
+
+	file := saveFileV1{Version: 1, Redirects: []redirectV1{}}
+	for hostname, urls := range hosts {
+		for url, target := range urls {
+			file.Redirects = append(file.Redirects, redirectV1{hostname, url, target})
+		}
+	}
+	return json.Marshal(file)
+}
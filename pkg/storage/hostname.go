@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// wildcardPrefix marks a hostname matching all subdomains, e.g. *.example.com matches www.example.com and a.b.example.com (but not example.com)
+const wildcardPrefix = "*."
+
+// AnyHost is the hostname matching all hostnames, it is used after all other hostnames
+const AnyHost = "*"
+
+// validateHostname checks that a hostname contains at most a wildcard as first label or is AnyHost
+func validateHostname(hostname string) error {
+	if hostname == AnyHost {
+		return nil
+	}
+
+	name := strings.TrimPrefix(hostname, wildcardPrefix)
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("invalid hostname %v, a wildcard is only allowed as first label (*.example.com)", hostname)
+	}
+	if name == "" || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid hostname %v", hostname)
+	}
+	return nil
+}
+
+// HasHost reports whether red has redirects or settings for hostname, directly or by a wildcard hostname or AnyHost
+func HasHost(red Redirector, hostname string) bool {
+	return hasHost(red, hostname, true)
+}
+
+// HasOwnHost reports whether red has redirects or settings for hostname, directly or by a wildcard hostname.
+// Unlike HasHost AnyHost is not considered, it matches every hostname a client sends.
+func HasOwnHost(red Redirector, hostname string) bool {
+	return hasHost(red, hostname, false)
+}
+
+// hasHost reports whether red has redirects or settings for a candidate of hostname, AnyHost only if anyHost is true
+func hasHost(red Redirector, hostname string, anyHost bool) bool {
+	for _, candidate := range hostCandidates(NormalizeHost(hostname)) {
+		if candidate == AnyHost && !anyHost {
+			continue
+		}
+		if len(red.GetRedirectsForHost(candidate)) > 0 || !red.GetHostSettings(candidate).empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// hostCandidates returns the hostnames to look up for a request host, most specific first:
+// the host as requested, the host without port, all wildcards matching it and AnyHost, e.g. for www.a.example.com:8080
+//
+//	www.a.example.com:8080, www.a.example.com, *.a.example.com, *.example.com, *.com, *
+//
+// IP addresses have no wildcards, IPv6 addresses keep their brackets like in NormalizeHost ([2001:db8::1]:8080, [2001:db8::1], *).
+func hostCandidates(host string) []string {
+	candidates := []string{host}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		candidates = append(candidates, host)
+	}
+
+	if net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")) != nil {
+		return append(candidates, AnyHost)
+	}
+
+	for i := strings.IndexByte(host, '.'); i >= 0 && i < len(host)-1; {
+		candidates = append(candidates, wildcardPrefix+host[i+1:])
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return append(candidates, AnyHost)
+}
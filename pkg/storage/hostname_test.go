@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostCandidates(t *testing.T) {
+	tests := []struct {
+		host       string
+		candidates []string
+	}{
+		{"example.com", []string{"example.com", "*.com", "*"}},
+		{"a.b.example.com", []string{"a.b.example.com", "*.b.example.com", "*.example.com", "*.com", "*"}},
+		{"example.com:8080", []string{"example.com:8080", "example.com", "*.com", "*"}},
+		{"www.example.com:8080", []string{"www.example.com:8080", "www.example.com", "*.example.com", "*.com", "*"}},
+		{"localhost", []string{"localhost", "*"}},
+		{"192.0.2.1", []string{"192.0.2.1", "*"}},
+		{"192.0.2.1:8080", []string{"192.0.2.1:8080", "192.0.2.1", "*"}},
+		{"[2001:db8::1]", []string{"[2001:db8::1]", "*"}},
+		{"[2001:db8::1]:8080", []string{"[2001:db8::1]:8080", "[2001:db8::1]", "*"}},
+		{"[::ffff:192.0.2.1]", []string{"[::ffff:192.0.2.1]", "*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if candidates := hostCandidates(tt.host); !reflect.DeepEqual(candidates, tt.candidates) {
+				t.Errorf("hostCandidates(%v) = %v, expected %v", tt.host, candidates, tt.candidates)
+			}
+		})
+	}
+}
+
+func TestGetTargetHostnames(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/", "https://example.org/exact")
+	mustAdd(t, red, "*.example.com", "/", "https://example.org/wildcard")
+	mustAdd(t, red, "www.example.com", "/", "https://example.org/www")
+	mustAdd(t, red, "*.b.example.com", "/", "https://example.org/b-wildcard")
+	mustAdd(t, red, "example.com:8080", "/", "https://example.org/port")
+	mustAdd(t, red, "[2001:db8::1]", "/", "https://example.org/ipv6")
+	mustAdd(t, red, "[2001:db8::2]:8080", "/", "https://example.org/ipv6-port")
+	mustAdd(t, red, "192.0.2.1", "/", "https://example.org/ipv4")
+
+	tests := []struct {
+		host   string
+		target string // empty if no redirect is found
+	}{
+		{"example.com", "https://example.org/exact"},
+		{"EXAMPLE.com.", "https://example.org/exact"},
+		{"www.example.com", "https://example.org/www"},
+		{"other.example.com", "https://example.org/wildcard"},
+		{"a.b.example.com", "https://example.org/b-wildcard"},
+		{"b.example.com", "https://example.org/wildcard"},
+		{"x.a.example.com", "https://example.org/wildcard"},
+		{"example.com:80", "https://example.org/exact"},
+		{"example.com:8080", "https://example.org/port"},
+		{"example.com:9090", "https://example.org/exact"},
+		{"www.example.com:8080", "https://example.org/www"},
+		{"other.example.com:8080", "https://example.org/wildcard"},
+		{"[2001:db8::1]", "https://example.org/ipv6"},
+		{"[2001:db8::1]:8080", "https://example.org/ipv6"},
+		{"[2001:DB8::2]:8080", "https://example.org/ipv6-port"},
+		{"[2001:db8::2]", ""},
+		{"192.0.2.1:8080", "https://example.org/ipv4"},
+		{"example.org", ""},
+		{"notexample.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			redirect, err := red.GetTarget(tt.host, "/")
+			switch {
+			case tt.target == "" && err == nil:
+				t.Errorf("%v redirects to %v, expected no redirect", tt.host, redirect.Target)
+			case tt.target != "" && err != nil:
+				t.Errorf("no redirect for %v: %v", tt.host, err)
+			case redirect.Target != tt.target:
+				t.Errorf("%v redirects to %v, expected %v", tt.host, redirect.Target, tt.target)
+			}
+		})
+	}
+
+	// the wildcard hostname only matches subdomains, example.com itself is not matched by *.example.com
+	red.RemoveRedirect(Redirect{Hostname: "example.com", URL: "/"})
+	if redirect, err := red.GetTarget("example.com", "/"); err == nil {
+		t.Errorf("example.com redirects to %v after its redirect was removed", redirect.Target)
+	}
+	assertTarget(t, red, "www2.example.com", "/", "https://example.org/wildcard")
+}
+
+func TestHasOwnHost(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/", "https://example.org/")
+	mustAdd(t, red, "*.example.net", "/", "https://example.org/")
+	mustAdd(t, red, AnyHost, "/", "https://example.org/")
+
+	tests := []struct {
+		hostname string
+		own      bool
+	}{
+		{"example.com", true},
+		{"www.example.net", true},
+		{"example.net", false},
+		{"unknown.org", false},
+	}
+	for _, tt := range tests {
+		if own := HasOwnHost(red, tt.hostname); own != tt.own {
+			t.Errorf("HasOwnHost(%v) = %v, expected %v", tt.hostname, own, tt.own)
+		}
+		// AnyHost matches every hostname
+		if !HasHost(red, tt.hostname) {
+			t.Errorf("HasHost(%v) = false, expected true", tt.hostname)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// HSTSPreloadMinAge is the minimum max-age for HSTS preload lists (one year)
+const HSTSPreloadMinAge = 31536000
+
+// validateHSTS checks that the HSTS settings form a valid Strict-Transport-Security header
+func (h HostSettings) validateHSTS() error {
+	if h.HSTSMaxAge < 0 {
+		return fmt.Errorf("invalid HSTS max-age %v", h.HSTSMaxAge)
+	}
+	if h.HSTSMaxAge == 0 && (h.HSTSIncludeSubDomains || h.HSTSPreload) {
+		return fmt.Errorf("HSTS includeSubDomains and preload require a max-age")
+	}
+	if h.HSTSPreload && (!h.HSTSIncludeSubDomains || h.HSTSMaxAge < HSTSPreloadMinAge) {
+		return fmt.Errorf("HSTS preload requires includeSubDomains and a max-age of at least %v seconds", HSTSPreloadMinAge)
+	}
+	return nil
+}
+
+// HSTSHeader returns the value of the Strict-Transport-Security header of HTTPS responses, empty if the hostname has no HSTS
+func (h HostSettings) HSTSHeader() string {
+	if h.HSTSMaxAge <= 0 {
+		return ""
+	}
+
+	header := "max-age=" + strconv.Itoa(h.HSTSMaxAge)
+	if h.HSTSIncludeSubDomains {
+		header += "; includeSubDomains"
+	}
+	if h.HSTSPreload {
+		header += "; preload"
+	}
+	return header
+}
+
+// SettingsFor returns the settings which apply to requests for hostname: the settings of the most specific hostname with settings
+// (see hostCandidates), settings of less specific hostnames are not merged. Without settings it returns default settings.
+func SettingsFor(red Redirector, hostname string) HostSettings {
+	hostname = NormalizeHost(hostname)
+	for _, candidate := range hostCandidates(hostname) {
+		if settings := red.GetHostSettings(candidate); !settings.empty() {
+			return settings
+		}
+	}
+	return HostSettings{Hostname: hostname}
+}
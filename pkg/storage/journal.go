@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCompactAfter is the number of journal records after which a JournalRedirect compacts its journal
+const DefaultCompactAfter = 1000
+
+// operations recorded in the journal
+const (
+	journalAdd        = "add"
+	journalRemove     = "remove"
+	journalRemoveHost = "removeHost"
+	journalSetHost    = "setHost"
+)
+
+// journalRecord is a single change, the journal stores one record as JSON per line
+type journalRecord struct {
+	Op       string
+	Redirect Redirect
+	Settings *HostSettings `json:",omitempty"` // only for setHost
+
+	ifAbsent bool // only for add: the redirect is only added if the URL has no redirect, it is replayed as plain add
+}
+
+// JournalRedirect is a Redirector which keeps all redirects in memory (see MapRedirect) and
+// appends every change to a journal file before it returns, so no change is lost on a crash.
+//
+// At start the snapshot file is loaded and the journal is replayed on top of it. A torn final record
+// (e.g. from a crash during a write, it has no newline) is discarded, other records which cannot be replayed are an error. When the journal has grown to compactAfter records,
+// it is compacted in the background: the current state is written to a new snapshot and the journal is truncated.
+// The snapshot uses the same format as the save file of MapRedirect.
+type JournalRedirect struct {
+	redirects    *MapRedirect // in-memory state, used for all lookups
+	snapshotFile string       // last compacted state
+	journalFile  string       // changes since snapshot
+	compactAfter int          // number of records to trigger a compaction
+
+	mu         sync.Mutex     // serializes changes, journal writes and compactions
+	journal    *os.File       // open journal, nil after Close
+	size       int64          // size of all complete records in journal
+	records    int            // number of records in journal
+	compacting bool           // background compaction is scheduled
+	closing    bool           // Close was called, no background compaction is started anymore
+	wg         sync.WaitGroup // background compactions
+	saves      *SaveMetrics   // records the snapshots written by compactions, nil records nothing
+	logger     *log.Logger    // logger for all output, nil for the standard logrus logger
+}
+
+// NewJournalRedirect loads the snapshot, replays the journal and opens the journal for new changes.
+// Missing files are treated as empty. compactAfter <= 0 uses DefaultCompactAfter, a nil logger uses the standard logrus logger.
+// schemes are the URL schemes allowed for targets, nil for DefaultTargetSchemes (see MapRedirect.SetTargetSchemes).
+func NewJournalRedirect(snapshotFile, journalFile string, compactAfter int, schemes []string, logger *log.Logger) (*JournalRedirect, error) {
+	if compactAfter <= 0 {
+		compactAfter = DefaultCompactAfter
+	}
+
+	j := &JournalRedirect{
+		redirects:    NewMapRedirect(logger),
+		snapshotFile: snapshotFile,
+		journalFile:  journalFile,
+		compactAfter: compactAfter,
+		logger:       logger,
+	}
+	j.redirects.SetTargetSchemes(schemes)
+
+	if err := j.loadSnapshot(j.redirects); err != nil {
+		return nil, err
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal %v: %v", journalFile, err)
+	}
+	j.journal = journal
+
+	j.log().WithField("records", j.records).Info("loaded snapshot and journal")
+	return j, nil
+}
+
+// log returns the logger of the journal with the files as fields
+func (j *JournalRedirect) log() *log.Entry {
+	return loggerOrStandard(j.logger).WithFields(log.Fields{"snapshot": j.snapshotFile, "journal": j.journalFile})
+}
+
+// loadSnapshot loads the snapshot file into redirects
+func (j *JournalRedirect) loadSnapshot(redirects *MapRedirect) error {
+	b, err := ioutil.ReadFile(j.snapshotFile)
+	if os.IsNotExist(err) {
+		j.log().Info("snapshot does not exist, starting with empty redirector")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read snapshot %v: %v", j.snapshotFile, err)
+	}
+
+	if err = json.Unmarshal(b, redirects); err != nil {
+		return fmt.Errorf("could not parse snapshot %v: %v", j.snapshotFile, err)
+	}
+	return nil
+}
+
+// replay applies all records of the journal. A final record which was not completely written is cut off the journal.
+func (j *JournalRedirect) replay() error {
+	b, err := ioutil.ReadFile(j.journalFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read journal %v: %v", j.journalFile, err)
+	}
+
+	j.size, j.records, err = j.applyRecords(j.redirects, b)
+	if err != nil {
+		return err
+	}
+
+	if torn := int64(len(b)) - j.size; torn > 0 {
+		j.log().WithField("bytes", torn).Warn("discarding torn record at end of journal")
+		if err = os.Truncate(j.journalFile, j.size); err != nil {
+			return fmt.Errorf("could not truncate journal %v: %v", j.journalFile, err)
+		}
+	}
+	return nil
+}
+
+// applyRecords applies the records of journal content b to redirects and returns the size and number of the applied records.
+// A final record without newline was not completely written and is left out. A complete record which cannot be parsed or applied
+// (e.g. because it is refused with the current settings) is not torn by a crash, it is an error naming the line of the record.
+func (j *JournalRedirect) applyRecords(redirects *MapRedirect, b []byte) (size int64, records int, err error) {
+	for size < int64(len(b)) {
+		rest := b[size:]
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			break // record was not completely written
+		}
+
+		var record journalRecord
+		if err = json.Unmarshal(rest[:end], &record); err != nil {
+			return size, records, j.recordError(records+1, "is not a valid record", err)
+		}
+		if err = apply(redirects, record); err != nil {
+			return size, records, j.recordError(records+1, "cannot be applied", err)
+		}
+
+		size += int64(end + 1)
+		records++
+	}
+	return size, records, nil
+}
+
+// recordError returns the error for a complete record of the journal in line which cannot be replayed
+func (j *JournalRedirect) recordError(line int, problem string, err error) error {
+	return fmt.Errorf("journal %v: line %v %v: %v (the journal is not changed, fix or remove the line to load it)", j.journalFile, line, problem, err)
+}
+
+// apply a record to redirects
+func apply(redirects *MapRedirect, record journalRecord) error {
+	switch record.Op {
+	case journalAdd:
+		if record.ifAbsent {
+			return redirects.AddRedirectIfAbsent(record.Redirect)
+		}
+		return redirects.AddRedirect(record.Redirect)
+	case journalRemove:
+		redirects.RemoveRedirect(record.Redirect)
+	case journalRemoveHost:
+		redirects.RemoveAllRedirectsForHost(record.Redirect)
+	case journalSetHost:
+		if record.Settings == nil {
+			return fmt.Errorf("journal operation %q without settings", record.Op)
+		}
+		return redirects.SetHostSettings(*record.Settings)
+	default:
+		return fmt.Errorf("unknown journal operation %q", record.Op)
+	}
+	return nil
+}
+
+// record applies a change and writes it to the journal.
+// Only changes which could be applied are journaled, if the journal cannot be written the change is rolled back.
+func (j *JournalRedirect) record(record journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.journal == nil {
+		return fmt.Errorf("journal %v is closed", j.journalFile)
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not encode journal record: %v", err)
+	}
+	b = append(b, '\n')
+
+	// all changes of j.redirects are serialized by j.mu, so the previous state can be restored
+	previous := j.redirects.snapshot()
+	if err = apply(j.redirects, record); err != nil {
+		return err
+	}
+
+	if _, err = j.journal.Write(b); err == nil {
+		err = j.journal.Sync()
+	}
+	if err != nil {
+		// remove a partial record, so later records stay readable
+		j.journal.Truncate(j.size)
+		j.redirects.replace(previous)
+		return fmt.Errorf("could not write journal %v: %v", j.journalFile, err)
+	}
+	j.size += int64(len(b))
+	j.records++
+
+	// Close waits for started compactions, so none may be added once it waits (see sync.WaitGroup)
+	if j.records >= j.compactAfter && !j.compacting && !j.closing {
+		j.compacting = true
+		j.wg.Add(1)
+		go func() {
+			defer j.wg.Done()
+			if err := j.Compact(); err != nil {
+				j.log().Errorf("could not compact journal: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// SetSaveMetrics records the snapshots written by compactions in saves (see NewSaveMetrics), nil records nothing
+func (j *JournalRedirect) SetSaveMetrics(saves *SaveMetrics) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.saves = saves
+}
+
+// Compact writes the current state to the snapshot file and truncates the journal
+func (j *JournalRedirect) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.compacting = false
+	return j.compact()
+}
+
+func (j *JournalRedirect) compact() error {
+	if j.journal == nil {
+		return fmt.Errorf("journal %v is closed", j.journalFile)
+	}
+
+	b, err := json.MarshalIndent(j.redirects, "", " ")
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %v", err)
+	}
+	start := time.Now()
+	err = WriteFileAtomic(j.snapshotFile, b, 0644)
+	j.saves.observe(j.snapshotFile, start, err)
+	if err != nil {
+		return fmt.Errorf("could not write snapshot %v: %v", j.snapshotFile, err)
+	}
+
+	// a crash before the truncation only replays changes already contained in the snapshot, which is harmless
+	if err = j.journal.Truncate(0); err == nil {
+		err = j.journal.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("could not truncate journal %v: %v", j.journalFile, err)
+	}
+
+	j.log().WithField("records", j.records).Info("compacted journal into snapshot")
+	j.size = 0
+	j.records = 0
+	return nil
+}
+
+// Reload loads the snapshot file again (e.g. after it was edited) and replays the journal on top of it,
+// so the changes since the last compaction are kept. The redirects are replaced atomically (see MapRedirect.Replace),
+// if the snapshot or the journal cannot be loaded the current redirects stay active.
+func (j *JournalRedirect) Reload() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.journal == nil {
+		return fmt.Errorf("journal %v is closed", j.journalFile)
+	}
+
+	loaded := NewMapRedirect(j.logger)
+	loaded.SetTargetSchemes(j.redirects.targetSchemes())
+	if err := j.loadSnapshot(loaded); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(j.journalFile)
+	if err != nil {
+		return fmt.Errorf("could not read journal %v: %v", j.journalFile, err)
+	}
+	if int64(len(b)) < j.size {
+		return fmt.Errorf("journal %v was truncated by someone else", j.journalFile)
+	}
+	// the journal only contains complete records, a failed write is truncated (see record)
+	if _, _, err = j.applyRecords(loaded, b[:j.size]); err != nil {
+		return err
+	}
+
+	j.redirects.Replace(loaded)
+	return nil
+}
+
+// Close waits for running compactions, compacts the journal and closes it.
+// Changes after Close fail.
+func (j *JournalRedirect) Close() error {
+	j.mu.Lock()
+	j.closing = true
+	j.mu.Unlock()
+	j.wg.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.journal == nil {
+		return nil
+	}
+
+	err := j.compact()
+	if closeErr := j.journal.Close(); err == nil {
+		err = closeErr
+	}
+	j.journal = nil
+	return err
+}
+
+func (j *JournalRedirect) GetAllRedirects() []Redirect {
+	return j.redirects.GetAllRedirects()
+}
+
+func (j *JournalRedirect) GetRedirectsForHost(hostname string) []Redirect {
+	return j.redirects.GetRedirectsForHost(hostname)
+}
+
+func (j *JournalRedirect) GetRedirect(hostname, url string) []Redirect {
+	return j.redirects.GetRedirect(hostname, url)
+}
+
+//GetTarget gets the redirect for a host and URL
+func (j *JournalRedirect) GetTarget(hostname string, url string) (Redirect, error) {
+	return j.redirects.GetTarget(hostname, url)
+}
+
+// AddRedirect adds or changes a new host and/or URL to the redirections and writes it to the journal.
+func (j *JournalRedirect) AddRedirect(redirect Redirect) error {
+	return j.record(journalRecord{Op: journalAdd, Redirect: redirect})
+}
+
+// AddRedirectIfAbsent adds a redirect like AddRedirect, but only if the hostname has no redirect for the URL yet (see MapRedirect.AddRedirectIfAbsent).
+func (j *JournalRedirect) AddRedirectIfAbsent(redirect Redirect) error {
+	return j.record(journalRecord{Op: journalAdd, Redirect: redirect, ifAbsent: true})
+}
+
+// RemoveRedirect deletes the redirection for a host and URL and writes it to the journal.
+func (j *JournalRedirect) RemoveRedirect(redirect Redirect) {
+	if err := j.record(journalRecord{Op: journalRemove, Redirect: redirect}); err != nil {
+		j.log().WithFields(redirect.logFields()).Errorf("could not remove redirect: %v", err)
+	}
+}
+
+// RemoveAllRedirectsForHost deletes all existing redirections for a host and writes it to the journal.
+func (j *JournalRedirect) RemoveAllRedirectsForHost(redirect Redirect) {
+	if err := j.record(journalRecord{Op: journalRemoveHost, Redirect: redirect}); err != nil {
+		j.log().WithField("hostname", redirect.Hostname).Errorf("could not remove redirects for host: %v", err)
+	}
+}
+
+func (j *JournalRedirect) GetAllHostSettings() []HostSettings {
+	return j.redirects.GetAllHostSettings()
+}
+
+func (j *JournalRedirect) GetHostSettings(hostname string) HostSettings {
+	return j.redirects.GetHostSettings(hostname)
+}
+
+// SetHostSettings sets the settings of a hostname and writes them to the journal.
+func (j *JournalRedirect) SetHostSettings(settings HostSettings) error {
+	return j.record(journalRecord{Op: journalSetHost, Settings: &settings})
+}
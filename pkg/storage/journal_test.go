@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// openJournal opens a JournalRedirect with snapshot and journal in dir
+func openJournal(t *testing.T, dir string, compactAfter int) *JournalRedirect {
+	t.Helper()
+	j, err := NewJournalRedirect(filepath.Join(dir, "redirects.json"), filepath.Join(dir, "redirects.journal"), compactAfter, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open journal: %v", err)
+	}
+	return j
+}
+
+// mustAdd adds a redirect and fails the test on errors
+func mustAdd(t *testing.T, red Redirector, hostname, url, target string) {
+	t.Helper()
+	if err := red.AddRedirect(Redirect{Hostname: hostname, URL: url, Target: target}); err != nil {
+		t.Fatalf("could not add %v%v: %v", hostname, url, err)
+	}
+}
+
+// assertTarget checks that hostname and url redirect to target
+func assertTarget(t *testing.T, red Redirector, hostname, url, target string) {
+	t.Helper()
+	redirect, err := red.GetTarget(hostname, url)
+	if err != nil {
+		t.Fatalf("no redirect for %v%v: %v", hostname, url, err)
+	}
+	if redirect.Target != target {
+		t.Fatalf("%v%v redirects to %v, expected %v", hostname, url, redirect.Target, target)
+	}
+}
+
+func TestJournalReloadKeepsJournaledChanges(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, dir, 0)
+	defer j.Close()
+
+	mustAdd(t, j, "example.com", "/compacted", "https://example.org/compacted")
+	if err := j.Compact(); err != nil {
+		t.Fatalf("could not compact: %v", err)
+	}
+	mustAdd(t, j, "example.com", "/journaled", "https://example.org/journaled")
+
+	if err := j.Reload(); err != nil {
+		t.Fatalf("could not reload: %v", err)
+	}
+	assertTarget(t, j, "example.com", "/compacted", "https://example.org/compacted")
+	assertTarget(t, j, "example.com", "/journaled", "https://example.org/journaled")
+
+	// changes of the snapshot are loaded, the journal is replayed on top of them
+	snapshot := []byte(`{"Version": 1, "Redirects": [
+		{"Hostname": "example.com", "URL": "/compacted", "Target": "https://example.org/edited"},
+		{"Hostname": "example.com", "URL": "/journaled", "Target": "https://example.org/edited"}
+	]}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "redirects.json"), snapshot, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Reload(); err != nil {
+		t.Fatalf("could not reload edited snapshot: %v", err)
+	}
+	assertTarget(t, j, "example.com", "/compacted", "https://example.org/edited")
+	assertTarget(t, j, "example.com", "/journaled", "https://example.org/journaled")
+
+	// a snapshot which cannot be loaded keeps the current redirects
+	if err := ioutil.WriteFile(filepath.Join(dir, "redirects.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Reload(); err == nil {
+		t.Fatal("reloading a damaged snapshot succeeded")
+	}
+	assertTarget(t, j, "example.com", "/journaled", "https://example.org/journaled")
+}
+
+// writeJournal replaces the journal in dir with content
+func writeJournal(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, "redirects.journal"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readJournal returns the content of the journal in dir
+func readJournal(t *testing.T, dir string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "redirects.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+const (
+	recordFirst    = `{"Op":"add","Redirect":{"Hostname":"example.com","URL":"/first","Target":"https://example.org/first"}}` + "\n"
+	recordSecond   = `{"Op":"add","Redirect":{"Hostname":"example.com","URL":"/second","Target":"https://example.org/second"}}` + "\n"
+	recordRefused  = `{"Op":"add","Redirect":{"Hostname":"example.com","URL":"/ftp","Target":"ftp://example.org/"}}` + "\n"
+	recordDamaged  = `{"Op":"add","Redirect":{"Hostname":"exa` + "\n"
+	recordTornTail = `{"Op":"add","Redirect":{"Hostname":"example.com","URL":"/torn"`
+)
+
+func TestJournalDiscardsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	writeJournal(t, dir, recordFirst+recordTornTail)
+
+	j := openJournal(t, dir, 0)
+	assertTarget(t, j, "example.com", "/first", "https://example.org/first")
+	if _, err := j.GetTarget("example.com", "/torn"); err == nil {
+		t.Fatal("torn record was applied")
+	}
+	if content := readJournal(t, dir); content != recordFirst {
+		t.Fatalf("torn record was not cut off, journal is %q", content)
+	}
+
+	// new records follow the last complete record
+	mustAdd(t, j, "example.com", "/second", "https://example.org/second")
+	if content := readJournal(t, dir); content != recordFirst+recordSecond {
+		t.Fatalf("journal is %q after adding a redirect", content)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("could not close journal: %v", err)
+	}
+}
+
+func TestJournalRefusesCompleteRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+	}{
+		{"damaged record in the middle", recordFirst + recordDamaged + recordSecond},
+		{"refused record in the middle", recordFirst + recordRefused + recordSecond},
+		{"damaged final record", recordFirst + recordDamaged},
+		{"refused final record", recordFirst + recordRefused},
+		{"refused final record before torn tail", recordFirst + recordRefused + recordTornTail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeJournal(t, dir, tt.journal)
+
+			j, err := NewJournalRedirect(filepath.Join(dir, "redirects.json"), filepath.Join(dir, "redirects.journal"), 0, nil, nil)
+			if err == nil {
+				j.Close()
+				t.Fatal("journal with a damaged or refused record was loaded")
+			}
+			if !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("error does not name the line of the record: %v", err)
+			}
+			if content := readJournal(t, dir); content != tt.journal {
+				t.Errorf("journal was changed to %q", content)
+			}
+		})
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, dir, 3)
+
+	mustAdd(t, j, "example.com", "/first", "https://example.org/first")
+	mustAdd(t, j, "example.com", "/second", "https://example.org/second")
+	j.RemoveRedirect(Redirect{Hostname: "example.com", URL: "/first"})
+	j.wg.Wait() // the third record starts a compaction in the background
+
+	if content := readJournal(t, dir); content != "" {
+		t.Fatalf("journal is %q after compaction", content)
+	}
+	mustAdd(t, j, "example.com", "/third", "https://example.org/third")
+	if err := j.Close(); err != nil {
+		t.Fatalf("could not close journal: %v", err)
+	}
+	if content := readJournal(t, dir); content != "" {
+		t.Fatalf("journal is %q after close", content)
+	}
+
+	// the snapshot contains all changes
+	j = openJournal(t, dir, 3)
+	defer j.Close()
+	if _, err := j.GetTarget("example.com", "/first"); err == nil {
+		t.Fatal("removed redirect was restored")
+	}
+	assertTarget(t, j, "example.com", "/second", "https://example.org/second")
+	assertTarget(t, j, "example.com", "/third", "https://example.org/third")
+}
+
+func TestJournalCloseDuringChanges(t *testing.T) {
+	dir := t.TempDir()
+	// every change starts a compaction, while Close waits for them
+	j := openJournal(t, dir, 1)
+
+	var writers sync.WaitGroup
+	added := make(chan string, 400)
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for n := 0; n < 100; n++ {
+				url := fmt.Sprintf("/%v/%v", i, n)
+				if j.AddRedirect(Redirect{Hostname: "example.com", URL: url, Target: "https://example.org" + url}) == nil {
+					added <- url
+				}
+			}
+		}(i)
+	}
+	if err := j.Close(); err != nil {
+		t.Errorf("could not close journal: %v", err)
+	}
+	writers.Wait()
+	close(added)
+
+	// all changes which succeeded are kept, changes after Close fail
+	j = openJournal(t, dir, 0)
+	defer j.Close()
+	for url := range added {
+		assertTarget(t, j, "example.com", url, "https://example.org"+url)
+	}
+}
@@ -3,31 +3,115 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// hostMap is the lookup table of MapRedirect: map[hostname]redirects
+// A hostMap is never modified once it has been published, changes always create a copy
+type hostMap map[string]*hostRedirects
+
 // MapRedirect saves redirects in a map in memory
-// Per default it uses a ruslog default logger, this can be overwritten with NewMapRedirector(logger)
+// It is safe for concurrent use: lookups read an immutable snapshot of the map, changes are
+// serialized, applied on a copy and the new snapshot is swapped in atomically.
+// Therefore lookups never block on changes (e.g. from the admin API).
+// The zero value is an empty MapRedirect ready to use.
+// Per default it uses the standard logrus logger, this can be overwritten with NewMapRedirect(logger)
 type MapRedirect struct {
-	Hosts  map[string]map[string]string // map[hostname][url]redirect
-	logger *log.Logger                  // default logger
+	hosts   atomic.Value // current hostMap snapshot
+	mu      sync.Mutex   // serializes all changes
+	logger  *log.Logger  // logger for all output, nil for the standard logrus logger
+	schemes []string     // URL schemes allowed for targets, nil for DefaultTargetSchemes
 }
 
-// NewMapRedirect allows to set the logger on the storage
-func NewMapRedirect(logger *log.Logger) MapRedirect {
-	r := MapRedirect{
-		Hosts:  nil,
+// NewMapRedirect allows to set the logger on the storage, nil uses the standard logrus logger
+func NewMapRedirect(logger *log.Logger) *MapRedirect {
+	r := &MapRedirect{
 		logger: logger,
 	}
 	return r
 }
 
-func convertMapToSlice(m map[string]map[string]string) []Redirect {
+// SetTargetSchemes sets the URL schemes allowed for the targets of redirects and default targets, which are added or loaded afterwards.
+// nil allows DefaultTargetSchemes (see ValidateTarget).
+func (red *MapRedirect) SetTargetSchemes(schemes []string) {
+	red.mu.Lock()
+	defer red.mu.Unlock()
+	red.schemes = schemes
+}
+
+// targetSchemes returns the URL schemes allowed for targets, nil for DefaultTargetSchemes
+func (red *MapRedirect) targetSchemes() []string {
+	red.mu.Lock()
+	defer red.mu.Unlock()
+	return red.schemes
+}
+
+// log returns the logger of the storage
+func (red *MapRedirect) log() *log.Logger {
+	return loggerOrStandard(red.logger)
+}
+
+// loggerOrStandard returns logger, or the standard logrus logger if it is nil
+func loggerOrStandard(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return log.StandardLogger()
+	}
+	return logger
+}
+
+// logFields returns the fields identifying a redirect in log entries
+func (r Redirect) logFields() log.Fields {
+	return log.Fields{"hostname": r.Hostname, "url": r.URL, "target": r.Target, "code": r.StatusCode()}
+}
+
+// snapshot returns the current lookup table, it must not be modified
+func (red *MapRedirect) snapshot() hostMap {
+	hosts, _ := red.hosts.Load().(hostMap)
+	return hosts
+}
+
+// update applies change to a copy of the current lookup table and publishes the copy if change succeeds.
+// The outer map is copied completely, change has to replace any hostRedirects it modifies.
+func (red *MapRedirect) update(change func(hosts hostMap) error) error {
+	red.mu.Lock()
+	defer red.mu.Unlock()
+
+	current := red.snapshot()
+	hosts := make(hostMap, len(current)+1)
+	for hostname, redirects := range current {
+		hosts[hostname] = redirects
+	}
+
+	if err := change(hosts); err != nil {
+		return err
+	}
+	red.hosts.Store(hosts)
+	return nil
+}
+
+// put replaces settings and redirects of a hostname, a hostname without redirects and settings is removed
+func (hosts hostMap) put(settings HostSettings, urls map[string]Redirect) error {
+	if len(urls) == 0 && settings.empty() {
+		delete(hosts, settings.Hostname)
+		return nil
+	}
+
+	redirects, err := newHostRedirects(settings, urls)
+	if err != nil {
+		return err
+	}
+	hosts[settings.Hostname] = redirects
+	return nil
+}
+
+func convertMapToSlice(m hostMap) []Redirect {
 	r := make([]Redirect, 0)
-	for hostname, urls := range m {
-		for url, target := range urls {
-			redirect := Redirect{hostname, url, target}
+	for _, redirects := range m {
+		for _, redirect := range redirects.urls {
 			r = append(r, redirect)
 		}
 	}
@@ -35,102 +119,249 @@ func convertMapToSlice(m map[string]map[string]string) []Redirect {
 }
 
 func (red *MapRedirect) GetAllRedirects() []Redirect {
-	return convertMapToSlice(red.Hosts)
+	return convertMapToSlice(red.snapshot())
 }
 
 func (red *MapRedirect) GetRedirectsForHost(hostname string) []Redirect {
-	log.Debugf("requested redirects for hostname %v", hostname)
+	red.log().WithField("hostname", hostname).Debug("requested redirects for hostname")
 
-	redirectHost, okHost := red.Hosts[hostname]
+	hostname = NormalizeHost(hostname)
+	redirectHost, okHost := red.snapshot()[hostname]
 	if !okHost {
 		return nil
 	}
 
-	m := map[string]map[string]string{hostname: redirectHost}
+	m := hostMap{hostname: redirectHost}
 
 	return convertMapToSlice(m)
 }
 
 func (red *MapRedirect) GetRedirect(hostname, url string) []Redirect {
-	log.Debugf("requested redirects for hostname %v url%v", hostname, url)
+	red.log().WithFields(log.Fields{"hostname": hostname, "url": url}).Debug("requested redirect")
 
-	redirectHost, okHost := red.Hosts[hostname]
+	redirectHost, okHost := red.snapshot()[NormalizeHost(hostname)]
 	if !okHost {
 		return nil
 	}
 
-	target, okURL := redirectHost[url]
+	redirect, okURL := redirectHost.urls[NormalizeURL(url)]
 	if !okURL {
 		return nil
 	}
 
-	redirect := Redirect{hostname, url, target}
-
 	return []Redirect{redirect}
 }
 
-//GetTarget gets a redirect target for a host and URL
-func (red *MapRedirect) GetTarget(hostname string, url string) (string, error) {
-	log.Debugf("GetTarget call for %v %v", hostname, url)
-
-	target := red.GetRedirect(hostname, url)
-
-	if target == nil || len(target) < 1 {
-		return "", fmt.Errorf("no redirect foud for %v%v", hostname, url)
+//GetTarget gets the redirect for a host and URL (path, optionally followed by ?query)
+//The host may contain a port. The most specific hostname with a redirect for the URL or a default target wins:
+//the exact host, the host without port, then wildcard hostnames from the longest to the shortest and AnyHost (see hostCandidates).
+//Within a hostname an exact URL wins over regular expression rules and prefix rules, the default target is used last (see hostRedirects.lookup).
+//Hostname and URL are normalized before the lookup (see NormalizeHost and NormalizeURL).
+//Redirects which are not valid at the current time are ignored.
+//A rule which expands to an invalid target for the URL returns a TargetError, the request must not be redirected.
+func (red *MapRedirect) GetTarget(hostname string, url string) (Redirect, error) {
+	hostname, url = NormalizeHost(hostname), NormalizeURL(url)
+	redirect, candidate, ok, err := red.snapshot().target(hostname, url, time.Now())
+	if err != nil {
+		red.log().WithFields(log.Fields{"hostname": hostname, "url": url, "candidate": candidate}).Infof("not redirected: %v", err)
+		return Redirect{}, err
+	}
+	if !ok {
+		return Redirect{}, fmt.Errorf("no redirect foud for %v%v", hostname, url)
 	}
 
-	log.Debugf("redirect found for host %v and url %v, target %v", hostname, url, target)
-	return target[0].Target, nil
+	// fields are only built with debug logging, lookups are on the hot path
+	if logger := red.log(); logger.IsLevelEnabled(log.DebugLevel) {
+		logger.WithFields(log.Fields{"hostname": hostname, "url": url, "candidate": candidate, "target": redirect.Target}).Debug("redirect found")
+	}
+	return redirect, nil
 }
 
 // AddRedirect adds or changes a new host and/or URL to the redirections.
+// Hostname and URL are stored normalized (see NormalizeHost and NormalizeURL).
+// An invalid redirect is rejected with a ValidationError, a redirect leading into a loop with the other redirects with a LoopError.
 func (red *MapRedirect) AddRedirect(redirect Redirect) error {
-	log.Printf("adding new entry %v%v -> %v", redirect.Hostname, redirect.URL, redirect.Target)
+	return red.addRedirect(redirect, true)
+}
 
-	if red.Hosts == nil {
-		log.Debugf("creating new MapRedirect.Hosts map in AddRedirect")
-		red.Hosts = make(map[string]map[string]string)
-	}
+// AddRedirectIfAbsent adds a redirect like AddRedirect, but only if the hostname has no redirect for the URL yet.
+// Otherwise an ExistsError with the existing redirect is returned, checking and adding are atomic.
+func (red *MapRedirect) AddRedirectIfAbsent(redirect Redirect) error {
+	return red.addRedirect(redirect, false)
+}
 
-	_, exists := red.Hosts[redirect.Hostname]
-	if !exists {
-		log.Debugf("creating new url map for host %v in AddRedirect", redirect.Hostname)
-		red.Hosts[redirect.Hostname] = make(map[string]string)
+// addRedirect adds a redirect, an existing redirect for the URL is only replaced if replace is true
+func (red *MapRedirect) addRedirect(redirect Redirect, replace bool) error {
+	if err := redirect.Validate(red.targetSchemes()...); err != nil {
+		return err
 	}
+	redirect = redirect.normalize()
 
-	red.Hosts[redirect.Hostname][redirect.URL] = redirect.Target
+	red.log().WithFields(redirect.logFields()).Info("adding new entry")
 
-	return nil
+	return red.update(func(hosts hostMap) error {
+		current, exists := hosts[redirect.Hostname]
+		if !exists {
+			red.log().WithField("hostname", redirect.Hostname).Debug("creating new url map for host in AddRedirect")
+		} else if existing, ok := current.urls[redirect.URL]; ok && !replace {
+			return &ExistsError{existing}
+		}
+
+		urls := current.copyURLs()
+		urls[redirect.URL] = redirect
+		if err := hosts.put(current.getSettings(redirect.Hostname), urls); err != nil {
+			return err
+		}
+		return hosts.checkLoop(redirect, time.Now())
+	})
 }
 
-// RemoveAllRedirectsForHost deletes all existing redirections for a host
+// RemoveAllRedirectsForHost deletes all existing redirections and the settings of a host
 func (red *MapRedirect) RemoveAllRedirectsForHost(redirect Redirect) {
-	if red.Hosts != nil {
-		delete(red.Hosts, redirect.Hostname)
+	redirect = redirect.normalize()
+	if _, exists := red.snapshot()[redirect.Hostname]; !exists {
+		return
 	}
+
+	red.update(func(hosts hostMap) error {
+		delete(hosts, redirect.Hostname)
+		return nil
+	})
 }
 
 // RemoveRedirect deletes all existing redirections for a host
 func (red *MapRedirect) RemoveRedirect(redirect Redirect) {
-	if red.Hosts == nil {
+	redirect = redirect.normalize()
+	if _, exists := red.snapshot()[redirect.Hostname]; !exists {
 		return
 	}
 
-	_, exists := red.Hosts[redirect.Hostname]
+	err := red.update(func(hosts hostMap) error {
+		current, exists := hosts[redirect.Hostname]
+		if !exists {
+			return nil
+		}
 
-	if !exists {
-		return
+		urls := current.copyURLs()
+		delete(urls, redirect.URL)
+		return hosts.put(current.settings, urls)
+	})
+	if err != nil {
+		red.log().WithFields(redirect.logFields()).Errorf("could not remove redirect: %v", err)
+	}
+}
+
+// GetAllHostSettings returns the settings of all hostnames which have settings
+func (red *MapRedirect) GetAllHostSettings() []HostSettings {
+	settings := make([]HostSettings, 0)
+	for _, redirects := range red.snapshot() {
+		if !redirects.settings.empty() {
+			settings = append(settings, redirects.settings)
+		}
+	}
+	return settings
+}
+
+// GetHostSettings returns the settings of a hostname, default settings if it has none
+func (red *MapRedirect) GetHostSettings(hostname string) HostSettings {
+	hostname = NormalizeHost(hostname)
+	return red.snapshot()[hostname].getSettings(hostname)
+}
+
+// SetHostSettings sets the settings of a hostname, default settings remove them.
+// Settings leading into a loop (e.g. a default target, or IgnoreCase matching the target of a redirect) are rejected with a LoopError.
+func (red *MapRedirect) SetHostSettings(settings HostSettings) error {
+	if err := settings.Validate(red.targetSchemes()...); err != nil {
+		return err
+	}
+	settings.Hostname = NormalizeHost(settings.Hostname)
+
+	red.log().WithFields(log.Fields{
+		"hostname": settings.Hostname, "query": settings.Query, "default": settings.Default, "defaultCode": settings.DefaultCode,
+	}).Info("setting host")
+
+	return red.update(func(hosts hostMap) error {
+		if err := hosts.put(settings, hosts[settings.Hostname].copyURLs()); err != nil {
+			return err
+		}
+		return hosts.checkHostLoops(settings.Hostname, time.Now())
+	})
+}
+
+// replace publishes hosts as new lookup table
+func (red *MapRedirect) replace(hosts hostMap) {
+	if hosts == nil {
+		hosts = make(hostMap)
 	}
 
-	delete(red.Hosts[redirect.Hostname], redirect.URL)
+	red.mu.Lock()
+	defer red.mu.Unlock()
+	red.hosts.Store(hosts)
+}
+
+// Replace atomically replaces all redirects with the redirects of other.
+// Lookups see either the old or the new redirects, but never a mix of both.
+func (red *MapRedirect) Replace(other *MapRedirect) {
+	red.replace(other.snapshot())
+}
+
+// MarshalJSON encodes all redirects and host settings in the save file format (see EncodeFile)
+func (red *MapRedirect) MarshalJSON() ([]byte, error) {
+	return EncodeFile(red.GetAllRedirects(), red.GetAllHostSettings())
+}
+
+// UnmarshalJSON replaces all redirects and host settings with the decoded ones, files of older versions are migrated (see DecodeFile).
+// Files with invalid redirects (see SetTargetSchemes) or redirect loops are rejected (see ValidateFile for a report of all problems).
+func (red *MapRedirect) UnmarshalJSON(b []byte) error {
+	redirects, hostSettings, version, err := DecodeFile(b, red.targetSchemes()...)
+	if err != nil {
+		return err
+	}
+	if version < FormatVersion {
+		red.log().WithFields(log.Fields{"from": version, "to": FormatVersion}).Debug("migrated save file")
+	}
+
+	settings, urls := groupByHost(redirects, hostSettings)
+	hosts := make(hostMap, len(settings))
+	for hostname, s := range settings {
+		if err = hosts.put(s, urls[hostname]); err != nil {
+			return fmt.Errorf("host %v: %v", hostname, err)
+		}
+	}
+	if err = hosts.checkLoops(time.Now()); err != nil {
+		return err
+	}
+	red.replace(hosts)
+	return nil
+}
+
+// groupByHost returns the normalized settings and redirects by hostname, hostnames with redirects but without settings get default settings
+func groupByHost(redirects []Redirect, hostSettings []HostSettings) (settings map[string]HostSettings, urls map[string]map[string]Redirect) {
+	settings = make(map[string]HostSettings)
+	urls = make(map[string]map[string]Redirect)
+	for _, s := range hostSettings {
+		s.Hostname = NormalizeHost(s.Hostname)
+		settings[s.Hostname] = s
+	}
+	for _, redirect := range redirects {
+		redirect = redirect.normalize()
+		if urls[redirect.Hostname] == nil {
+			urls[redirect.Hostname] = make(map[string]Redirect)
+		}
+		urls[redirect.Hostname][redirect.URL] = redirect
+		if _, ok := settings[redirect.Hostname]; !ok {
+			settings[redirect.Hostname] = HostSettings{Hostname: redirect.Hostname}
+		}
+	}
+	return settings, urls
 }
 
 //GetJSON of all redirects
 func (red *MapRedirect) GetJSON() ([]byte, error) {
-	return json.MarshalIndent(red.Hosts, "", " ")
+	return json.MarshalIndent(red, "", " ")
 }
 
 //SetJSON for all redirects
 func (red *MapRedirect) SetJSON(b []byte) error {
-	return json.Unmarshal(b, red.Hosts)
+	return red.UnmarshalJSON(b)
 }
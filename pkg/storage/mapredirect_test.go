@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// quietLogger returns a logger discarding all output, e.g. of the many changes of a benchmark
+func quietLogger() *log.Logger {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// writeRedirects adds and removes redirects of hostname until stop is closed
+func writeRedirects(red *MapRedirect, hostname string, stop <-chan struct{}) {
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		url := fmt.Sprintf("/%v", i%100)
+		if i%200 < 100 {
+			red.AddRedirect(Redirect{Hostname: hostname, URL: url, Target: "https://example.org" + url})
+		} else {
+			red.RemoveRedirect(Redirect{Hostname: hostname, URL: url})
+		}
+	}
+}
+
+func TestMapRedirectConcurrentReadsAndWrites(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/stable", "https://example.org/stable")
+
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(hostname string) {
+			defer writers.Done()
+			writeRedirects(red, hostname, stop)
+		}(fmt.Sprintf("w%v.example.com", i))
+	}
+
+	var readers sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			for n := 0; n < 2000; n++ {
+				// redirects of other hostnames change, the stable redirect is always found
+				redirect, err := red.GetTarget("example.com", "/stable")
+				if err != nil || redirect.Target != "https://example.org/stable" {
+					errs <- fmt.Errorf("lookup %v during writes returned %v, %v", n, redirect.Target, err)
+					return
+				}
+				red.GetTarget(fmt.Sprintf("w%v.example.com", i), fmt.Sprintf("/%v", n%100))
+				red.GetRedirectsForHost(fmt.Sprintf("w%v.example.com", i))
+			}
+		}(i)
+	}
+
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkGetTarget(b *testing.B) {
+	red := NewMapRedirect(quietLogger())
+	for i := 0; i < 1000; i++ {
+		url := fmt.Sprintf("/%v", i)
+		red.AddRedirect(Redirect{Hostname: "example.com", URL: url, Target: "https://example.org" + url})
+	}
+
+	benchmarks := []struct {
+		name   string
+		writer bool
+	}{
+		{"without writes", false},
+		{"with concurrent writes", true},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			stop := make(chan struct{})
+			var writer sync.WaitGroup
+			if bm.writer {
+				writer.Add(1)
+				go func() {
+					defer writer.Done()
+					writeRedirects(red, "writer.example.com", stop)
+				}()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := red.GetTarget("example.com", fmt.Sprintf("/%v", i%1000)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			writer.Wait()
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"fmt"
+	neturl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefixWildcard at the end of an URL makes it a prefix rule, e.g. /docs/* matches /docs/a/b.
+// The remainder of the path after the prefix (a/b) is appended to the path of the target (see appendPath).
+const prefixWildcard = "*"
+
+// regexpMarker at the start of an URL makes it a regular expression rule, e.g. ~^/article\.php\?id=([0-9]+)$
+// The expression is matched against path and query of the request (path?query), $1 or ${1} in the target
+// are replaced with the submatches. Rules use RE2 syntax (package regexp), so matching runs in linear time.
+const regexpMarker = "~"
+
+// MaxRulesPerHost is the maximum number of regular expression rules per hostname
+const MaxRulesPerHost = 100
+
+// maxRegexpLength is the maximum length of a regular expression rule
+const maxRegexpLength = 1024
+
+// ConflictError is returned when a redirect or host settings are valid on their own, but conflict with the other redirects of the hostname
+type ConflictError struct {
+	Hostname string // hostname with the conflict
+	Reason   string // description of the conflict
+}
+
+func (e *ConflictError) Error() string {
+	return e.Reason
+}
+
+// ExistsError is returned by AddRedirectIfAbsent if the hostname already has a redirect for the URL
+type ExistsError struct {
+	Existing Redirect // the existing redirect
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("redirect %v%v already exists", e.Existing.Hostname, e.Existing.URL)
+}
+
+// TargetError is returned by GetTarget if a prefix or regular expression rule matches, but the target expanded for the request is invalid
+// (see ValidateTarget), e.g. a path which became a protocol-relative URL //example.com/. The request must not be redirected.
+type TargetError struct {
+	Hostname string // hostname of the rule
+	URL      string // URL of the rule
+	Target   string // expanded target
+	Reason   error  // why the expanded target is invalid
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("rule %v%v expands to an invalid target: %v", e.Hostname, e.URL, e.Reason)
+}
+
+// hostRedirects are all redirects and the settings of a hostname, it is never modified once created
+type hostRedirects struct {
+	settings HostSettings           // settings of the hostname
+	urls     map[string]Redirect    // all redirects by URL (exact URLs, prefix and regular expression rules)
+	paths    map[string]Redirect    // exact URLs and prefix rules by folded path (see HostSettings.foldPath)
+	queries  map[string][]queryRule // exact URLs with query by folded path, most parameters first
+	rules    []regexpRule           // regular expression rules in order of priority
+}
+
+// regexpRule is a compiled regular expression rule
+type regexpRule struct {
+	regexp   *regexp.Regexp
+	redirect Redirect
+}
+
+// newHostRedirects creates the redirects of a hostname and compiles its rules.
+// Rules are ordered by descending Priority, rules with the same priority by their URL.
+// URLs which are equal after folding (e.g. /a and /A with IgnoreCase) are rejected.
+func newHostRedirects(settings HostSettings, urls map[string]Redirect) (*hostRedirects, error) {
+	h := &hostRedirects{
+		settings: settings,
+		urls:     urls,
+		paths:    make(map[string]Redirect),
+		queries:  make(map[string][]queryRule),
+	}
+
+	for url, redirect := range urls {
+		switch {
+		case strings.HasPrefix(url, regexpMarker):
+			re, err := compileRule(url)
+			if err != nil {
+				return nil, err
+			}
+			h.rules = append(h.rules, regexpRule{re, redirect})
+		case strings.Contains(url, "?"):
+			path, params, err := parseQueryRule(url)
+			if err != nil {
+				return nil, err
+			}
+			path = settings.foldPath(path)
+			h.queries[path] = append(h.queries[path], queryRule{params, redirect})
+		default:
+			key := settings.foldPath(url)
+			if strings.HasSuffix(url, prefixWildcard) {
+				key = settings.foldCase(strings.TrimSuffix(url, prefixWildcard)) + prefixWildcard
+			}
+			if other, exists := h.paths[key]; exists {
+				return nil, &ConflictError{settings.Hostname, fmt.Sprintf("urls %v and %v are equal for host %v", other.URL, url, settings.Hostname)}
+			}
+			h.paths[key] = redirect
+		}
+	}
+
+	for _, rules := range h.queries {
+		sort.Slice(rules, func(i, j int) bool {
+			if len(rules[i].params) != len(rules[j].params) {
+				return len(rules[i].params) > len(rules[j].params)
+			}
+			return rules[i].redirect.URL < rules[j].redirect.URL
+		})
+	}
+
+	if len(h.rules) > MaxRulesPerHost {
+		return nil, &ConflictError{settings.Hostname, fmt.Sprintf("too many regular expression rules (%v), at most %v are allowed per hostname", len(h.rules), MaxRulesPerHost)}
+	}
+
+	sort.Slice(h.rules, func(i, j int) bool {
+		a, b := h.rules[i].redirect, h.rules[j].redirect
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.URL < b.URL
+	})
+	return h, nil
+}
+
+// getSettings returns the settings of the hostname, h can be nil
+func (h *hostRedirects) getSettings(hostname string) HostSettings {
+	if h == nil {
+		return HostSettings{Hostname: hostname}
+	}
+	return h.settings
+}
+
+// copyURLs returns a modifiable copy of the url map, h can be nil
+func (h *hostRedirects) copyURLs() map[string]Redirect {
+	if h == nil {
+		return make(map[string]Redirect)
+	}
+
+	c := make(map[string]Redirect, len(h.urls)+1)
+	for url, redirect := range h.urls {
+		c[url] = redirect
+	}
+	return c
+}
+
+// lookup finds the redirect for an URL (path, optionally followed by ?query), h can be nil.
+// Without matching redirect the default target of the hostname is used.
+// The Query of the returned redirect is the policy in effect, the query of the request is already added to its target.
+// A rule which matches, but expands to an invalid target, returns a TargetError (see match).
+func (h *hostRedirects) lookup(url string, now time.Time) (Redirect, bool, error) {
+	if h == nil {
+		return Redirect{}, false, nil
+	}
+
+	redirect, ok, err := h.match(url, now)
+	if err != nil {
+		return Redirect{}, true, err
+	}
+	if !ok {
+		redirect, ok = h.settings.defaultRedirect()
+	}
+	if !ok {
+		return Redirect{}, false, nil
+	}
+
+	if redirect.Query == "" {
+		redirect.Query = h.settings.Query
+	}
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		redirect.Target = applyQuery(redirect.Target, url[i+1:], redirect.Query)
+	}
+	return redirect, true, nil
+}
+
+// match finds the redirect for an URL (path, optionally followed by ?query).
+// Exact URLs with query for the path win (the rule with most parameters first), then the exact path,
+// then regular expression rules in order of priority, then the longest prefix rule.
+// Redirects which are not valid at now are skipped, the target of a redirect is the one scheduled for now.
+// For rules the target of the returned redirect is already expanded, an invalid expanded target is a TargetError.
+func (h *hostRedirects) match(url string, now time.Time) (Redirect, bool, error) {
+	path, query := url, ""
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		path, query = url[:i], url[i+1:]
+	}
+
+	key := h.settings.foldPath(path)
+
+	if rules := h.queries[key]; len(rules) > 0 && query != "" {
+		params, _ := neturl.ParseQuery(query)
+		for _, rule := range rules {
+			if redirect, active := rule.redirect.at(now); active && rule.matches(params) {
+				return redirect, true, nil
+			}
+		}
+	}
+
+	if redirect, ok := h.paths[key]; ok && !strings.HasSuffix(redirect.URL, prefixWildcard) {
+		if redirect, active := redirect.at(now); active {
+			return redirect, true, nil
+		}
+	}
+
+	for _, rule := range h.rules {
+		redirect, active := rule.redirect.at(now)
+		if !active {
+			continue
+		}
+		match := rule.regexp.FindStringSubmatchIndex(url)
+		if match == nil {
+			continue
+		}
+		target := string(rule.regexp.ExpandString(nil, redirect.Target, url, match))
+		return redirect.expanded(target)
+	}
+
+	// normalized paths are ASCII, so folding the case keeps all positions
+	prefix := h.settings.foldCase(path)
+	for i := len(prefix); i >= 0; i-- {
+		redirect, ok := h.paths[prefix[:i]+prefixWildcard]
+		if !ok {
+			continue
+		}
+		if redirect, active := redirect.at(now); active {
+			rest := path[i:]
+			if strings.HasSuffix(prefix[:i], "/") && rest != "" {
+				rest = "/" + rest // the separator at the end of the prefix also separates target and rest
+			}
+			target, err := appendPath(redirect.Target, rest)
+			if err != nil {
+				return Redirect{}, true, &TargetError{redirect.Hostname, redirect.URL, redirect.Target + rest, err}
+			}
+			return redirect.expanded(target)
+		}
+	}
+	return Redirect{}, false, nil
+}
+
+// expanded returns the redirect with the target expanded from its target for a request, a TargetError if the expanded target
+// is invalid or has another scheme than the target of the rule. The rule was validated, but a request can still e.g.
+// expand /$1 to //example.com/, a protocol-relative URL leaving the hostname.
+func (r Redirect) expanded(target string) (Redirect, bool, error) {
+	scheme := ""
+	if u, err := neturl.Parse(r.Target); err == nil {
+		scheme = u.Scheme
+	}
+	if err := ValidateTarget(target, scheme); err != nil {
+		return Redirect{}, true, &TargetError{r.Hostname, r.URL, target, err}
+	}
+	r.Target = target
+	return r, true, nil
+}
+
+// appendPath appends rest, the remaining path of a request after a prefix rule, to the path of target.
+// Query and fragment of target are kept (https://example.com/docs?ref=old and /a give https://example.com/docs/a?ref=old).
+// rest is separated with / from a target without path, a / at the end of the target path is not doubled.
+func appendPath(target, rest string) (string, error) {
+	if rest == "" {
+		return target, nil
+	}
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Opaque != "" {
+		return "", fmt.Errorf("target %v has no path", target)
+	}
+
+	path := u.EscapedPath()
+	switch {
+	case strings.HasSuffix(path, "/"):
+		rest = strings.TrimLeft(rest, "/")
+	case path == "" && !strings.HasPrefix(rest, "/"):
+		path = "/"
+	}
+	if u.Path, err = neturl.PathUnescape(path + rest); err != nil {
+		return "", err
+	}
+	u.RawPath = path + rest
+	return u.String(), nil
+}
+
+// compileRule compiles the regular expression of a rule URL (starting with regexpMarker)
+func compileRule(url string) (*regexp.Regexp, error) {
+	expr := strings.TrimPrefix(url, regexpMarker)
+	if expr == "" || len(expr) > maxRegexpLength {
+		return nil, fmt.Errorf("invalid url %v, a regular expression needs 1 to %v characters", url, maxRegexpLength)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %v: %v", expr, err)
+	}
+	return re, nil
+}
+
+// validateURL checks that a regular expression rule compiles, other URLs contain at most a prefix wildcard at the end
+// and a query only in exact URLs
+func validateURL(url string) error {
+	if strings.HasPrefix(url, regexpMarker) {
+		_, err := compileRule(url)
+		return err
+	}
+
+	if strings.Contains(strings.TrimSuffix(url, prefixWildcard), prefixWildcard) {
+		return fmt.Errorf("invalid url %v, a wildcard is only allowed at the end (/docs/*)", url)
+	}
+	if strings.Contains(url, "?") {
+		if strings.HasSuffix(url, prefixWildcard) {
+			return fmt.Errorf("invalid url %v, a prefix rule cannot contain a query", url)
+		}
+		_, _, err := parseQueryRule(url)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// lookupCase is a request and the expected target, empty if the request must not be redirected
+type lookupCase struct {
+	url    string
+	target string
+}
+
+// assertLookups checks the target of every request of tests for hostname
+func assertLookups(t *testing.T, red *MapRedirect, hostname string, tests []lookupCase) {
+	t.Helper()
+	for _, tt := range tests {
+		redirect, err := red.GetTarget(hostname, tt.url)
+		switch {
+		case tt.target == "" && err == nil:
+			t.Errorf("%v%v redirects to %v, expected no redirect", hostname, tt.url, redirect.Target)
+		case tt.target != "" && err != nil:
+			t.Errorf("no redirect for %v%v: %v", hostname, tt.url, err)
+		case redirect.Target != tt.target:
+			t.Errorf("%v%v redirects to %v, expected %v", hostname, tt.url, redirect.Target, tt.target)
+		}
+	}
+}
+
+func TestPrefixRules(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/docs/*", "https://new.example.com/manual/")
+	mustAdd(t, red, "example.com", "/docs/exact", "https://new.example.com/exact")
+	mustAdd(t, red, "example.com", "/docs/api/*", "https://api.example.com/v2")
+	mustAdd(t, red, "example.com", "/x/*", "https://new.example.com")
+	mustAdd(t, red, "example.com", "/p*", "/")
+	mustAdd(t, red, "example.com", "/q/*", "https://new.example.com/docs?ref=old")
+	mustAdd(t, red, "example.com", "/f/*", "/page#top")
+
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/docs/a/b", "https://new.example.com/manual/a/b"},
+		{"/docs/", "https://new.example.com/manual/"},
+		{"/docs/exact", "https://new.example.com/exact"},
+		{"/docs/api/users", "https://api.example.com/v2/users"},
+		{"/docs/a%20b", "https://new.example.com/manual/a%20b"},
+		// the rest of the path cannot change the hostname of the target
+		{"/x/@evil.com", "https://new.example.com/@evil.com"},
+		{"/x/a", "https://new.example.com/a"},
+		{"/p/evil.com", "/evil.com"},
+		{"/p//evil.com", "/evil.com"},
+		{"/p\\evil.com", "/%5Cevil.com"},
+		// query and fragment of the target are kept
+		{"/q/a", "https://new.example.com/docs/a?ref=old"},
+		{"/f/x", "/page/x#top"},
+		{"/other", ""},
+	})
+}
+
+func TestPrefixRuleTargetNeedsPath(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	red.SetTargetSchemes([]string{"http", "https", "mailto"})
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "/mail/*", Target: "mailto:someone@example.com"}); err == nil {
+		t.Errorf("prefix rule with mailto target is accepted")
+	}
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "/mail", Target: "mailto:someone@example.com"}); err != nil {
+		t.Errorf("exact URL with mailto target is rejected: %v", err)
+	}
+}
+
+func TestRegexpRules(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", `~^/user/(\d+)$`, "https://example.org/profile?id=$1")
+	mustAdd(t, red, "example.com", "~^/go/(.*)$", "/$1")
+	mustAdd(t, red, "example.com", "~^/to/(.*)$", "https://example.org/$1")
+	mustAdd(t, red, "example.com", "~^/(?P<lang>en|de)/(.*)$", "https://example.org/${lang}/$2")
+	mustAdd(t, red, "example.com", "/go/exact", "https://example.org/exact")
+	mustAdd(t, red, "example.com", "/go/*", "https://example.org/prefix/")
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "~^/(de)/(.*)$", Target: "https://example.de/$2", Priority: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/user/42", "https://example.org/profile?id=42"},
+		{"/user/x", ""},
+		{"/go/a/b", "/a/b"},
+		// an exact URL wins over rules, rules win over prefix rules
+		{"/go/exact", "https://example.org/exact"},
+		{"/en/page", "https://example.org/en/page"},
+		// a higher priority wins
+		{"/de/page", "https://example.de/page"},
+		// the expansion must not leave the hostname or change the scheme
+		{"/go//evil.com", ""},
+		{"/go/\\evil.com", "/%5Cevil.com"}, // normalized to %5C, not a path leaving the hostname
+		{"/go/%5Cevil.com", "/%5Cevil.com"},
+		{"/to/@evil.com", "https://example.org/@evil.com"},
+	})
+
+	if _, err := red.GetTarget("example.com", "/go//evil.com"); err != nil {
+		if _, ok := err.(*TargetError); !ok {
+			t.Errorf("invalid expanded target returns %T, expected a TargetError", err)
+		}
+	}
+}
+
+func TestRegexpRuleLimits(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	for _, url := range []string{"~", "~(", "~" + strings.Repeat("a", maxRegexpLength+1)} {
+		if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: url, Target: "/"}); err == nil {
+			t.Errorf("rule %.20v is accepted", url)
+		}
+	}
+	for i := 0; i < MaxRulesPerHost; i++ {
+		mustAdd(t, red, "example.com", fmt.Sprintf("~^/r%v$", i), "/target")
+	}
+	err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "~^/one-more$", Target: "/target"})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("rule %v of the hostname returns %v, expected a ConflictError", MaxRulesPerHost+1, err)
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Hostnames and URLs are normalized when redirects are stored and when they are looked up, so that
+// equivalent spellings find the same redirect. Hostnames are lowercased, a trailing dot and the default
+// ports 80 and 443 are removed and internationalized names are converted to ASCII (punycode).
+// In paths percent-encodings of unreserved characters are decoded, all other percent-encodings use
+// upper case hex digits and characters which are not allowed in a path are percent-encoded (RFC 3986, 6.2.2).
+// Regular expression rules and queries are not changed.
+//
+// Case-insensitive paths and optional trailing slashes can be enabled per hostname (see HostSettings).
+
+// NormalizeHost returns the normalized form of a hostname, optionally followed by a port
+func NormalizeHost(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, ""
+	}
+
+	h = strings.TrimSuffix(strings.ToLower(h), ".")
+	if ascii, err := idna.ToASCII(h); err == nil {
+		h = ascii
+	}
+
+	switch {
+	case port != "" && port != "80" && port != "443":
+		return net.JoinHostPort(h, port)
+	case err == nil && strings.Contains(h, ":"):
+		return "[" + h + "]" // IPv6 address without port
+	}
+	return h
+}
+
+// NormalizeURL returns the normalized form of an URL (path, optionally followed by ?query)
+func NormalizeURL(url string) string {
+	if strings.HasPrefix(url, regexpMarker) {
+		return url
+	}
+
+	path, query := url, ""
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		path, query = url[:i], url[i:]
+	}
+	return normalizePath(path) + query
+}
+
+// normalize returns the redirect with normalized hostname and URL
+func (r Redirect) normalize() Redirect {
+	r.Hostname = NormalizeHost(r.Hostname)
+	r.URL = NormalizeURL(r.URL)
+	return r
+}
+
+// normalizePath canonicalizes the percent-encoding of a path
+func normalizePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '%' && i+2 < len(path) && isHex(path[i+1]) && isHex(path[i+2]) {
+			c = unhex(path[i+1])<<4 | unhex(path[i+2])
+			i += 2
+			if isUnreserved(c) {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+			continue
+		}
+		if isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isUnreserved returns true for characters which never need percent-encoding
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// foldPath returns the key of a path for lookups, depending on the settings of the hostname.
+// With IgnoreCase the path is lowercased, with TrailingSlash a trailing slash is removed (except for the root path).
+func (h HostSettings) foldPath(path string) string {
+	path = h.foldCase(path)
+	if h.TrailingSlash && len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// foldCase returns the path lowercased with IgnoreCase, otherwise unchanged
+func (h HostSettings) foldCase(path string) string {
+	if h.IgnoreCase {
+		return strings.ToLower(path)
+	}
+	return path
+}
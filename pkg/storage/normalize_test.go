@@ -0,0 +1,92 @@
+package storage
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.COM", "www.example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:80", "example.com"},
+		{"example.com:443", "example.com"},
+		{"example.com:8080", "example.com:8080"},
+		{"Example.com.:8080", "example.com:8080"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"BÜCHER.de:443", "xn--bcher-kva.de"},
+		{"*.Example.com", "*.example.com"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:DB8::1]:443", "[2001:db8::1]"},
+		{"[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeHost(tt.host); got != tt.want {
+			t.Errorf("NormalizeHost(%v) = %v, expected %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"/foo", "/foo"},
+		{"/%66oo", "/foo"},
+		{"/a%2fb", "/a%2Fb"},
+		{"/a%2Fb", "/a%2Fb"},
+		{"/a b", "/a%20b"},
+		{"/a%20b", "/a%20b"},
+		{"/ä", "/%C3%A4"},
+		{"/%c3%a4", "/%C3%A4"},
+		{"/50%", "/50%25"},
+		{"/%zz", "/%25zz"},
+		{"/a\\b", "/a%5Cb"},
+		{"/~user/a-b_c.d", "/~user/a-b_c.d"},
+		{"/a:b@c!$&'()*+,;=", "/a:b@c!$&'()*+,;="},
+		// queries and regular expressions are not changed
+		{"/%66oo?q=%66%20", "/foo?q=%66%20"},
+		{"~^/%66oo (.*)$", "~^/%66oo (.*)$"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeURL(tt.url); got != tt.want {
+			t.Errorf("NormalizeURL(%v) = %v, expected %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizedLookups(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "Bücher.DE.", "/%66oo", "https://example.org/foo")
+	mustAdd(t, red, "example.com", "/Docs/", "https://example.org/docs")
+
+	assertLookups(t, red, "xn--bcher-kva.de:443", []lookupCase{
+		{"/foo", "https://example.org/foo"},
+		{"/f%6f%6F", "https://example.org/foo"},
+	})
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/Docs/", "https://example.org/docs"},
+		{"/docs/", ""},
+		{"/Docs", ""},
+	})
+
+	if err := red.SetHostSettings(HostSettings{Hostname: "example.com", IgnoreCase: true, TrailingSlash: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertLookups(t, red, "EXAMPLE.com", []lookupCase{
+		{"/Docs/", "https://example.org/docs"},
+		{"/docs/", "https://example.org/docs"},
+		{"/DOCS", "https://example.org/docs"},
+		{"/docs//", ""},
+	})
+
+	// URLs which are equal after folding conflict
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "/docs", Target: "https://example.org/other"}); err == nil {
+		t.Errorf("URL equal to /Docs/ after folding is accepted")
+	}
+	mustAdd(t, red, "other.com", "/A", "https://example.org/a")
+	mustAdd(t, red, "other.com", "/a", "https://example.org/a")
+	if err := red.SetHostSettings(HostSettings{Hostname: "other.com", IgnoreCase: true}); err == nil {
+		t.Errorf("IgnoreCase is accepted for a host with URLs differing only in case")
+	}
+}
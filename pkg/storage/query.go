@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Query policies define what happens with the query string of a request.
+// A redirect without policy uses the policy of its hostname (see HostSettings), without both the query is dropped.
+const (
+	QueryDrop     = "drop"     // the query of the request is discarded, the target is used as is
+	QueryPass     = "pass"     // the query of the request is appended to the query of the target as is
+	QueryMerge    = "merge"    // the parameters of the request are merged into the target query, parameters of the target win
+	QueryOverride = "override" // the parameters of the request are merged into the target query, parameters of the request win
+)
+
+// validateQueryPolicy checks that policy is empty or a known query policy
+func validateQueryPolicy(policy string) error {
+	switch policy {
+	case "", QueryDrop, QueryPass, QueryMerge, QueryOverride:
+		return nil
+	}
+	return fmt.Errorf("invalid query policy %v, allowed are drop, pass, merge and override", policy)
+}
+
+// applyQuery adds the query of a request to target according to policy.
+// A fragment of the target stays at the end.
+func applyQuery(target, query, policy string) string {
+	if query == "" || policy == "" || policy == QueryDrop {
+		return target
+	}
+
+	fragment := ""
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	targetQuery := ""
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target, targetQuery = target[:i], target[i+1:]
+	}
+
+	switch policy {
+	case QueryPass:
+		if targetQuery != "" {
+			query = targetQuery + "&" + query
+		}
+	case QueryMerge, QueryOverride:
+		params, _ := url.ParseQuery(targetQuery)
+		request, _ := url.ParseQuery(query)
+		for key, values := range request {
+			if _, exists := params[key]; exists && policy == QueryMerge {
+				continue
+			}
+			params[key] = values
+		}
+		query = params.Encode()
+	}
+	return target + "?" + query + fragment
+}
+
+// queryRule is an exact URL with query (e.g. /search?lang=en), it matches requests for the path
+// which contain all parameters of the rule with the same values, further parameters are ignored.
+type queryRule struct {
+	params   url.Values
+	redirect Redirect
+}
+
+// parseQueryRule returns the path and parameters of an URL with query
+func parseQueryRule(rule string) (path string, params url.Values, err error) {
+	i := strings.IndexByte(rule, '?')
+	path = rule[:i]
+	if params, err = url.ParseQuery(rule[i+1:]); err != nil {
+		return "", nil, fmt.Errorf("invalid query in url %v: %v", rule, err)
+	}
+	if len(params) == 0 {
+		return "", nil, fmt.Errorf("invalid url %v, a query needs at least one parameter", rule)
+	}
+	return path, params, nil
+}
+
+// matches returns true if request contains all parameters of the rule
+func (q queryRule) matches(request url.Values) bool {
+	for key, values := range q.params {
+		for _, value := range values {
+			if !contains(request[key], value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
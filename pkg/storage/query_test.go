@@ -0,0 +1,85 @@
+package storage
+
+import "testing"
+
+func TestApplyQuery(t *testing.T) {
+	tests := []struct {
+		target, query, policy string
+		want                  string
+	}{
+		{"https://example.org/a", "x=1", "", "https://example.org/a"},
+		{"https://example.org/a", "x=1", QueryDrop, "https://example.org/a"},
+		{"https://example.org/a", "", QueryPass, "https://example.org/a"},
+		{"https://example.org/a", "x=1&y=2", QueryPass, "https://example.org/a?x=1&y=2"},
+		{"https://example.org/a?x=0", "x=1", QueryPass, "https://example.org/a?x=0&x=1"},
+		{"https://example.org/a?x=0#top", "y=1", QueryPass, "https://example.org/a?x=0&y=1#top"},
+		{"https://example.org/a?x=0&z=3", "x=1&y=2", QueryMerge, "https://example.org/a?x=0&y=2&z=3"},
+		{"https://example.org/a?x=0&z=3", "x=1&y=2", QueryOverride, "https://example.org/a?x=1&y=2&z=3"},
+		{"https://example.org/a#top", "y=1", QueryMerge, "https://example.org/a?y=1#top"},
+		{"/local", "a=%2F&b", QueryMerge, "/local?a=%2F&b="},
+	}
+	for _, tt := range tests {
+		if got := applyQuery(tt.target, tt.query, tt.policy); got != tt.want {
+			t.Errorf("query %q with policy %q on %v gives %v, expected %v", tt.query, tt.policy, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestQueryRules(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/search", "https://example.org/search")
+	mustAdd(t, red, "example.com", "/search?lang=en", "https://example.org/en")
+	mustAdd(t, red, "example.com", "/search?lang=en&q=go", "https://example.org/en/go")
+	mustAdd(t, red, "example.com", "/search?tag=a&tag=b", "https://example.org/ab")
+
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/search", "https://example.org/search"},
+		{"/search?lang=de", "https://example.org/search"},
+		{"/search?lang=en", "https://example.org/en"},
+		{"/search?x=1&lang=en", "https://example.org/en"},
+		// the rule with most parameters wins
+		{"/search?q=go&lang=en", "https://example.org/en/go"},
+		{"/search?q=rust&lang=en", "https://example.org/en"},
+		// repeated parameters need all values
+		{"/search?tag=a", "https://example.org/search"},
+		{"/search?tag=b&tag=a", "https://example.org/ab"},
+		{"/other?lang=en", ""},
+	})
+
+	for _, url := range []string{"/search?", "/search?%zz", "/docs/*?x=1"} {
+		if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: url, Target: "https://example.org/"}); err == nil {
+			t.Errorf("invalid url %v is accepted", url)
+		}
+	}
+}
+
+func TestQueryPolicies(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/host", "https://example.org/host?src=a")
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "/own", Target: "https://example.org/own?src=a", Query: QueryOverride}); err != nil {
+		t.Fatal(err)
+	}
+	if err := red.AddRedirect(Redirect{Hostname: "example.com", URL: "/bad", Target: "https://example.org/", Query: "keep"}); err == nil {
+		t.Errorf("unknown query policy is accepted")
+	}
+
+	// without policy of the host the query is dropped
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/host?src=b", "https://example.org/host?src=a"},
+		{"/own?src=b", "https://example.org/own?src=b"},
+	})
+
+	if err := red.SetHostSettings(HostSettings{Hostname: "example.com", Query: QueryMerge}); err != nil {
+		t.Fatal(err)
+	}
+	assertLookups(t, red, "example.com", []lookupCase{
+		{"/host?src=b&x=1", "https://example.org/host?src=a&x=1"},
+		// the policy of the redirect wins over the policy of the host
+		{"/own?src=b", "https://example.org/own?src=b"},
+	})
+
+	redirect, err := red.GetTarget("example.com", "/host?x=1")
+	if err != nil || redirect.Query != QueryMerge {
+		t.Errorf("policy in effect is %q (%v), expected %v", redirect.Query, err, QueryMerge)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ScheduledTarget changes the target of a redirect at a point in time
+type ScheduledTarget struct {
+	From   time.Time //time from which Target is used
+	Target string    //forwarding address from From on
+}
+
+// at returns the redirect as it is in effect at time t, with the target of the latest scheduled change before t.
+// active is false if the redirect is not valid at t.
+func (r Redirect) at(t time.Time) (redirect Redirect, active bool) {
+	if r.ValidFrom != nil && t.Before(*r.ValidFrom) {
+		return r, false
+	}
+	if r.ValidUntil != nil && !t.Before(*r.ValidUntil) {
+		return r, false
+	}
+
+	var from time.Time
+	for _, change := range r.Schedule {
+		if !t.Before(change.From) && !change.From.Before(from) {
+			r.Target, from = change.Target, change.From
+		}
+	}
+	return r, true
+}
+
+// expiredBefore returns true if the redirect was valid until a time before t
+func (r Redirect) expiredBefore(t time.Time) bool {
+	return r.ValidUntil != nil && r.ValidUntil.Before(t)
+}
+
+// validateValidity checks that the validity period is not empty and all scheduled changes have a time and target
+func (r Redirect) validateValidity() error {
+	if r.ValidFrom != nil && r.ValidUntil != nil && !r.ValidFrom.Before(*r.ValidUntil) {
+		return fmt.Errorf("valid from %v has to be before valid until %v", r.ValidFrom, r.ValidUntil)
+	}
+	for _, change := range r.Schedule {
+		if change.From.IsZero() || change.Target == "" {
+			return fmt.Errorf("a scheduled target requires a time and a target")
+		}
+	}
+	return nil
+}
+
+// RemoveExpired removes all redirects of red which expired before t and returns the number of removed redirects.
+// Used with a grace period, it purges expired redirects after they have been unused for a while.
+// Removals are logged to logger, nil uses the standard logrus logger.
+func RemoveExpired(red Redirector, t time.Time, logger *log.Logger) int {
+	removed := 0
+	for _, redirect := range red.GetAllRedirects() {
+		if !redirect.expiredBefore(t) {
+			continue
+		}
+		loggerOrStandard(logger).WithFields(redirect.logFields()).WithField("validUntil", redirect.ValidUntil).Info("removing expired redirect")
+		red.RemoveRedirect(redirect)
+		removed++
+	}
+	return removed
+}
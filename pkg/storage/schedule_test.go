@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRemoveExpired(t *testing.T) {
+	now := time.Date(2018, 6, 15, 0, 0, 0, 0, time.UTC)
+	until := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	red := NewMapRedirect(quietLogger())
+	for _, redirect := range []Redirect{
+		{Hostname: "example.com", URL: "/permanent", Target: "https://example.org/"},
+		{Hostname: "example.com", URL: "/future", Target: "https://example.org/", ValidUntil: until(time.Hour)},
+		{Hostname: "example.com", URL: "/recent", Target: "https://example.org/", ValidUntil: until(-time.Hour)},
+		{Hostname: "example.com", URL: "/old", Target: "https://example.org/", ValidUntil: until(-48 * time.Hour)},
+	} {
+		if err := red.AddRedirect(redirect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	// only redirects expired for longer than the grace period are removed, each removal is logged
+	if removed := RemoveExpired(red, now.Add(-24*time.Hour), logger); removed != 1 {
+		t.Errorf("%v redirects removed, expected 1", removed)
+	}
+	if !strings.Contains(out.String(), "/old") || strings.Count(out.String(), "removing expired redirect") != 1 {
+		t.Errorf("removal is not logged: %v", out.String())
+	}
+
+	var urls []string
+	for _, redirect := range red.GetRedirectsForHost("example.com") {
+		urls = append(urls, redirect.URL)
+	}
+	sort.Strings(urls)
+	if got := strings.Join(urls, " "); got != "/future /permanent /recent" {
+		t.Errorf("remaining redirects are %v", got)
+	}
+}
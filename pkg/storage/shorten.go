@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultShortAlphabet are the characters of generated short codes, characters which are easily confused (0O1Il) are left out
+const DefaultShortAlphabet = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// DefaultShortLength is the length of generated short codes
+const DefaultShortLength = 6
+
+// maxShortLength is the maximum length of short codes
+const maxShortLength = 64
+
+// shortenAttempts is the number of generated codes tried per length, the length is increased if all of them are taken
+const shortenAttempts = 10
+
+// DefaultReservedCodes are short codes which cannot be used, e.g. because they are paths of a website on the same hostname
+var DefaultReservedCodes = []string{"admin", "api", "app", "assets", "favicon", "health", "login", "logout", "metrics", "redirects", "robots", "static"}
+
+// ShortenRequest is a target to create a short URL for
+type ShortenRequest struct {
+	Hostname string // hostname of the short URL
+	Target   string // forwarding address
+	Short    string `json:",omitempty"` // custom short code (vanity code), empty generates a code
+	Code     int    `json:",omitempty"` // HTTP status code of the redirect, 0 for DefaultCode
+}
+
+// Shortener creates redirects with short codes (the URL /code) for targets
+type Shortener struct {
+	alphabet string
+	length   int
+	reserved []string
+
+	mu sync.Mutex // serializes shortening, so concurrent requests for a target get the same short URL
+}
+
+// NewShortener creates a shortener generating codes of length characters of alphabet, which are not one of reserved (ignoring case).
+// Empty alphabet uses DefaultShortAlphabet, length 0 DefaultShortLength and nil reserved DefaultReservedCodes.
+func NewShortener(alphabet string, length int, reserved []string) (*Shortener, error) {
+	if alphabet == "" {
+		alphabet = DefaultShortAlphabet
+	}
+	if length == 0 {
+		length = DefaultShortLength
+	}
+	if reserved == nil {
+		reserved = DefaultReservedCodes
+	}
+
+	if err := validateShort(alphabet); err != nil {
+		return nil, fmt.Errorf("invalid alphabet: %v", err)
+	}
+	for i, c := range alphabet {
+		if strings.IndexRune(alphabet[:i], c) >= 0 {
+			return nil, fmt.Errorf("invalid alphabet: character %q is repeated", c)
+		}
+	}
+	if len(alphabet) < 2 {
+		return nil, fmt.Errorf("invalid alphabet: at least 2 characters are required")
+	}
+	if length < 1 || length > maxShortLength {
+		return nil, fmt.Errorf("invalid length %v, allowed are 1 to %v", length, maxShortLength)
+	}
+
+	return &Shortener{alphabet: alphabet, length: length, reserved: reserved}, nil
+}
+
+// validateShort checks that a short code only contains letters, digits, - and _, so it can be used as path without encoding
+func validateShort(short string) error {
+	if short == "" || len(short) > maxShortLength {
+		return fmt.Errorf("short code has to be 1 to %v characters long", maxShortLength)
+	}
+	for _, c := range short {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in short code %v, allowed are letters, digits, - and _", c, short)
+		}
+	}
+	return nil
+}
+
+// isReserved reports whether short is one of the reserved codes (ignoring case)
+func (s *Shortener) isReserved(short string) bool {
+	for _, reserved := range s.reserved {
+		if strings.EqualFold(short, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the request without looking at existing redirects: the custom short code and the resulting redirect.
+// schemes are the URL schemes allowed for the target (see Redirect.Validate).
+func (s *Shortener) Validate(req ShortenRequest, schemes ...string) error {
+	if err := s.validateCode(req); err != nil {
+		return err
+	}
+	short := req.Short
+	if short == "" {
+		short = s.alphabet[:1]
+	}
+	return req.redirect(short).Validate(schemes...)
+}
+
+// validateCode checks the custom short code of req, if it has one
+func (s *Shortener) validateCode(req ShortenRequest) error {
+	if req.Short == "" {
+		return nil
+	}
+	if err := validateShort(req.Short); err != nil {
+		return err
+	}
+	if s.isReserved(req.Short) {
+		return fmt.Errorf("short code %v is reserved", req.Short)
+	}
+	return nil
+}
+
+// redirect returns the redirect of the request for short
+func (req ShortenRequest) redirect(short string) Redirect {
+	return Redirect{Hostname: req.Hostname, URL: "/" + short, Target: req.Target, Code: req.Code}
+}
+
+// Shorten returns the redirect of a short URL for the target of req, created is false if an existing redirect is returned.
+// Without custom code an existing short URL of the hostname for the same target and code is returned, otherwise a free code is generated.
+// A custom code which is used for another target is a ConflictError.
+// Redirects are only added if their URL is free (see Redirector.AddRedirectIfAbsent), so no existing redirect is replaced,
+// also not one added concurrently by other requests than shortening. The redirect is validated by red.
+func (s *Shortener) Shorten(red Redirector, req ShortenRequest) (redirect Redirect, created bool, err error) {
+	if err = s.validateCode(req); err != nil {
+		return Redirect{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Short != "" {
+		redirect, err = add(red, req.redirect(req.Short))
+		if exists, ok := err.(*ExistsError); ok {
+			if isShortFor(exists.Existing, req) {
+				return exists.Existing, false, nil
+			}
+			return Redirect{}, false, &ConflictError{exists.Existing.Hostname, fmt.Sprintf("short code %v is already used for %v", req.Short, exists.Existing.Target)}
+		}
+		return redirect, err == nil, err
+	}
+
+	if existing, ok := findShort(red, req); ok {
+		return existing, false, nil
+	}
+	conflicts := 0
+	for attempt := 0; ; attempt++ {
+		length := s.length + attempt/shortenAttempts
+		if length > maxShortLength {
+			return Redirect{}, false, &ConflictError{NormalizeHost(req.Hostname), "no free short code found"}
+		}
+		short, err := s.generate(length)
+		if err != nil {
+			return Redirect{}, false, err
+		}
+		if s.isReserved(short) {
+			continue
+		}
+
+		redirect, err = add(red, req.redirect(short))
+		if _, exists := err.(*ExistsError); exists {
+			continue
+		}
+		if _, conflict := err.(*ConflictError); conflict && conflicts < shortenAttempts {
+			// equal to another URL of the hostname after folding (e.g. with IgnoreCase),
+			// conflicts which do not depend on the code are returned after some attempts
+			conflicts++
+			continue
+		}
+		return redirect, err == nil, err
+	}
+}
+
+// add adds redirect if its URL is free and returns it as stored (normalized)
+func add(red Redirector, redirect Redirect) (Redirect, error) {
+	if err := red.AddRedirectIfAbsent(redirect); err != nil {
+		return Redirect{}, err
+	}
+	return redirect.normalize(), nil
+}
+
+// generate returns a random code of length characters of the alphabet
+func (s *Shortener) generate(length int) (string, error) {
+	max := big.NewInt(int64(len(s.alphabet)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("could not generate short code: %v", err)
+		}
+		b[i] = s.alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// isShortFor reports whether redirect is a plain short URL for the target and code of req
+// (an exact URL /code without query, validity and schedule)
+func isShortFor(redirect Redirect, req ShortenRequest) bool {
+	return redirect.Target == req.Target && redirect.Code == req.Code && redirect.Query == "" &&
+		redirect.ValidFrom == nil && redirect.ValidUntil == nil && len(redirect.Schedule) == 0 &&
+		validateShort(strings.TrimPrefix(redirect.URL, "/")) == nil
+}
+
+// findShort returns the short URL of the hostname for the target of req, the shortest code if there are several
+func findShort(red Redirector, req ShortenRequest) (Redirect, bool) {
+	var found []Redirect
+	for _, redirect := range red.GetRedirectsForHost(req.Hostname) {
+		if isShortFor(redirect, req) {
+			found = append(found, redirect)
+		}
+	}
+	if len(found) == 0 {
+		return Redirect{}, false
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if len(found[i].URL) != len(found[j].URL) {
+			return len(found[i].URL) < len(found[j].URL)
+		}
+		return found[i].URL < found[j].URL
+	})
+	return found[0], true
+}
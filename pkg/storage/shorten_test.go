@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewShortener(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		length   int
+		valid    bool
+	}{
+		{"", 0, true},
+		{"ab", 1, true},
+		{"abc-_", maxShortLength, true},
+		{"a", 6, false},
+		{"aba", 6, false},
+		{"ab/", 6, false},
+		{"ab", -1, false},
+		{"ab", maxShortLength + 1, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewShortener(tt.alphabet, tt.length, nil); (err == nil) != tt.valid {
+			t.Errorf("NewShortener(%q, %v) returns %v, expected valid %v", tt.alphabet, tt.length, err, tt.valid)
+		}
+	}
+}
+
+func TestShortenIdempotent(t *testing.T) {
+	shortener, err := NewShortener("", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := NewMapRedirect(quietLogger())
+	req := ShortenRequest{Hostname: "Example.com", Target: "https://example.org/a"}
+
+	first, created, err := shortener.Shorten(red, req)
+	if err != nil || !created {
+		t.Fatalf("first shorten returns created %v: %v", created, err)
+	}
+	if first.Hostname != "example.com" || len(first.URL) != 1+DefaultShortLength || strings.ContainsAny(first.URL[1:], "0O1Il") {
+		t.Errorf("unexpected short URL %v%v", first.Hostname, first.URL)
+	}
+	assertTarget(t, red, "example.com", first.URL, "https://example.org/a")
+
+	// the same target gets the same short URL, also when requested concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			again, created, err := shortener.Shorten(red, req)
+			if err != nil || created || again.URL != first.URL {
+				t.Errorf("shorten again returns %v (created %v): %v, expected %v", again.URL, created, err, first.URL)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// another code or another target get another short URL
+	for _, other := range []ShortenRequest{
+		{Hostname: "example.com", Target: "https://example.org/a", Code: 301},
+		{Hostname: "example.com", Target: "https://example.org/b"},
+		{Hostname: "other.com", Target: "https://example.org/a"},
+	} {
+		redirect, created, err := shortener.Shorten(red, other)
+		if err != nil || !created || (redirect.Hostname == first.Hostname && redirect.URL == first.URL) {
+			t.Errorf("shorten %v returns %v%v (created %v): %v", other, redirect.Hostname, redirect.URL, created, err)
+		}
+	}
+	if n := len(red.GetAllRedirects()); n != 4 {
+		t.Errorf("%v redirects stored, expected 4", n)
+	}
+}
+
+func TestShortenCustomCodes(t *testing.T) {
+	shortener, err := NewShortener("", 0, []string{"admin", "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := NewMapRedirect(quietLogger())
+	mustAdd(t, red, "example.com", "/taken", "https://example.org/taken")
+	mustAdd(t, red, "example.com", "/rule/*", "https://example.org/rule/")
+
+	tests := []struct {
+		short   string
+		target  string
+		created bool
+		err     bool
+	}{
+		{"docs", "https://example.org/docs", true, false},
+		{"docs", "https://example.org/docs", false, false}, // same target again
+		{"docs", "https://example.org/other", false, true}, // used for another target
+		{"taken", "https://example.org/taken", false, false},
+		{"taken", "https://example.org/other", false, true},
+		{"Admin", "https://example.org/", false, true}, // reserved, ignoring case
+		{"api", "https://example.org/", false, true},
+		{"a/b", "https://example.org/", false, true},
+		{"a b", "https://example.org/", false, true},
+		{strings.Repeat("a", maxShortLength+1), "https://example.org/", false, true},
+		{"bad", "javascript:alert(1)", false, true},
+	}
+	for _, tt := range tests {
+		req := ShortenRequest{Hostname: "example.com", Target: tt.target, Short: tt.short}
+		redirect, created, err := shortener.Shorten(red, req)
+		if (err != nil) != tt.err || created != tt.created {
+			t.Errorf("shorten %v to %v returns created %v: %v", tt.short, tt.target, created, err)
+			continue
+		}
+		if err == nil && (redirect.URL != "/"+tt.short || redirect.Target != tt.target) {
+			t.Errorf("shorten %v to %v returns %v to %v", tt.short, tt.target, redirect.URL, redirect.Target)
+		}
+		if err == nil && shortener.Validate(req) != nil {
+			t.Errorf("request %v is stored but not valid: %v", req, shortener.Validate(req))
+		}
+	}
+	if _, isConflict := shortener.Validate(ShortenRequest{Hostname: "example.com", Target: "https://example.org/", Short: "admin"}).(*ConflictError); isConflict {
+		t.Errorf("reserved code is a conflict instead of an invalid request")
+	}
+}
+
+func TestShortenReservedGenerated(t *testing.T) {
+	// with a single code of length 1 which is reserved, codes of length 2 are generated
+	shortener, err := NewShortener("ab", 1, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := NewMapRedirect(quietLogger())
+	redirect, created, err := shortener.Shorten(red, ShortenRequest{Hostname: "example.com", Target: "https://example.org/"})
+	if err != nil || !created || len(redirect.URL) != 3 {
+		t.Errorf("shorten returns %v (created %v): %v, expected a code of 2 characters", redirect.URL, created, err)
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsDays is the number of days for which daily hit counters are kept
+const StatsDays = 400
+
+// statsDateFormat is the format of the days of daily hit counters (UTC)
+const statsDateFormat = "2006-01-02"
+
+// HitCount are the hits of a redirect, identified by its hostname and URL (the stored URL, e.g. the prefix rule).
+// Redirects to the default target of a hostname have an empty URL.
+type HitCount struct {
+	Hostname string
+	URL      string
+	Total    int64            //number of hits (within the requested days)
+	LastHit  time.Time        //time of the last hit
+	Daily    map[string]int64 `json:",omitempty"` //number of hits per day (UTC, 2006-01-02)
+}
+
+// StatsFilter selects hit counters, empty fields match all
+type StatsFilter struct {
+	Hostname string
+	URL      string
+	From     time.Time //first day to count, zero for all days
+	To       time.Time //last day to count, zero for all days
+	Top      int       //maximum number of results, 0 for all
+}
+
+type statsKey struct {
+	hostname, url string
+}
+
+// hitCounter are the hits of a redirect, its mutex is only held to count a hit or to copy the counter
+type hitCounter struct {
+	mu    sync.Mutex
+	count HitCount
+}
+
+// Stats counts the hits of redirects, it is safe for concurrent use.
+// Every redirect has its own counter, so hits of different redirects do not wait for each other
+// and reading the counters (e.g. to save them) never blocks counting other redirects.
+// The zero value is an empty Stats ready to use.
+type Stats struct {
+	hits sync.Map // statsKey -> *hitCounter
+}
+
+// Hit counts a hit of a redirect at time t
+func (s *Stats) Hit(hostname, url string, t time.Time) {
+	day := t.UTC().Format(statsDateFormat)
+
+	key := statsKey{hostname, url}
+	c, exists := s.hits.Load(key)
+	if !exists {
+		c, _ = s.hits.LoadOrStore(key, &hitCounter{count: HitCount{Hostname: hostname, URL: url, Daily: make(map[string]int64)}})
+	}
+	counter := c.(*hitCounter)
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	count := &counter.count
+	count.Total++
+	if t.After(count.LastHit) {
+		count.LastHit = t
+	}
+	if _, exists := count.Daily[day]; !exists {
+		prune(count.Daily, t)
+	}
+	count.Daily[day]++
+}
+
+// Retain drops the hit counters of all redirects for which keep returns false, e.g. of removed redirects (see HasRedirect)
+func (s *Stats) Retain(keep func(hostname, url string) bool) {
+	s.hits.Range(func(k, _ interface{}) bool {
+		if key := k.(statsKey); !keep(key.hostname, key.url) {
+			s.hits.Delete(key)
+		}
+		return true
+	})
+}
+
+// copy returns a copy of the hit counter with the daily hits between from and to (formatted days, empty for no limit).
+// With a limit Total only counts the hits within it.
+func (c *hitCounter) copy(from, to string) HitCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ranged := from != "" || to != ""
+	count := HitCount{Hostname: c.count.Hostname, URL: c.count.URL, Total: c.count.Total, LastHit: c.count.LastHit, Daily: make(map[string]int64)}
+	if ranged {
+		count.Total = 0
+	}
+	for day, hits := range c.count.Daily {
+		if from != "" && day < from || to != "" && day > to {
+			continue
+		}
+		count.Daily[day] = hits
+		if ranged {
+			count.Total += hits
+		}
+	}
+	return count
+}
+
+// prune removes daily counters older than StatsDays before t
+func prune(daily map[string]int64, t time.Time) {
+	oldest := t.UTC().AddDate(0, 0, -StatsDays).Format(statsDateFormat)
+	for day := range daily {
+		if day < oldest {
+			delete(daily, day)
+		}
+	}
+}
+
+// Get returns the hit counters matching filter, ordered by descending number of hits.
+// With a date range, Total and Daily only contain the hits within the range and redirects without hits are omitted.
+func (s *Stats) Get(filter StatsFilter) []HitCount {
+	from, to := "", ""
+	if !filter.From.IsZero() {
+		from = filter.From.Format(statsDateFormat)
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.Format(statsDateFormat)
+	}
+	ranged := from != "" || to != ""
+
+	result := make([]HitCount, 0)
+	s.hits.Range(func(k, c interface{}) bool {
+		key := k.(statsKey)
+		if filter.Hostname != "" && filter.Hostname != key.hostname || filter.URL != "" && filter.URL != key.url {
+			return true
+		}
+		if count := c.(*hitCounter).copy(from, to); !ranged || count.Total > 0 {
+			result = append(result, count)
+		}
+		return true
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.URL < b.URL
+	})
+	if filter.Top > 0 && len(result) > filter.Top {
+		result = result[:filter.Top]
+	}
+	return result
+}
+
+// MarshalJSON encodes all hit counters as list
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Get(StatsFilter{}))
+}
+
+// UnmarshalJSON replaces all hit counters with the decoded ones, it is meant for loading the counters before hits are counted
+func (s *Stats) UnmarshalJSON(b []byte) error {
+	var counts []HitCount
+	if err := json.Unmarshal(b, &counts); err != nil {
+		return err
+	}
+
+	s.Retain(func(string, string) bool { return false })
+	for _, count := range counts {
+		if count.Daily == nil {
+			count.Daily = make(map[string]int64)
+		}
+		s.hits.Store(statsKey{count.Hostname, count.URL}, &hitCounter{count: count})
+	}
+	return nil
+}
+
+// HasRedirect reports whether red has the redirect of a hit counter: the redirect of hostname and url
+// or, for an empty url, the default target of hostname.
+func HasRedirect(red Redirector, hostname, url string) bool {
+	if url == "" {
+		return red.GetHostSettings(hostname).Default != ""
+	}
+	return len(red.GetRedirect(hostname, url)) > 0
+}
@@ -1,19 +1,161 @@
 package storage
 
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultCode is the HTTP status code of a redirect without code
+const DefaultCode = http.StatusTemporaryRedirect
+
 //Redirect entry declaration
 type Redirect struct {
 	Hostname string //hostname of the redirector
 	URL      string //URL on the hostname
 	Target   string //forwarding address
+	Code     int    `json:",omitempty"` //HTTP status code of the redirect, 0 for DefaultCode
+	Priority int    `json:",omitempty"` //order of regular expression rules, higher priorities are matched first
+	Query    string `json:",omitempty"` //query policy (see QueryDrop), empty for the policy of the hostname
+
+	ValidFrom  *time.Time        `json:",omitempty"` //the redirect is used from this time on, nil for always
+	ValidUntil *time.Time        `json:",omitempty"` //the redirect is used until this time, nil for always
+	Schedule   []ScheduledTarget `json:",omitempty"` //changes of the target, the latest change which has started wins over Target
+}
+
+// StatusCode returns the HTTP status code to use for the redirect
+func (r Redirect) StatusCode() int {
+	if r.Code == 0 {
+		return DefaultCode
+	}
+	return r.Code
+}
+
+// ValidationError is returned when a redirect or host settings are invalid on their own (see Redirect.Validate and HostSettings.Validate)
+type ValidationError struct {
+	Reason string // description of the invalid value
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// validationError returns err as ValidationError, nil if err is nil
+func validationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{err.Error()}
+}
+
+// Validate checks that all required fields are set, the targets are valid and the code is a redirect status code.
+// schemes are the URL schemes allowed for targets, none for DefaultTargetSchemes (see ValidateTarget).
+// Loops are only detected when the redirect is added, as they depend on the other redirects.
+// Errors are a ValidationError.
+func (r Redirect) Validate(schemes ...string) error {
+	return validationError(r.validate(schemes))
+}
+
+func (r Redirect) validate(schemes []string) error {
+	if r.Hostname == "" || r.URL == "" || r.Target == "" {
+		return fmt.Errorf("hostname, url and target are required")
+	}
+	if err := validateHostname(r.Hostname); err != nil {
+		return err
+	}
+	if err := validateURL(r.URL); err != nil {
+		return err
+	}
+	if err := r.validateTargets(schemes); err != nil {
+		return err
+	}
+	if err := ValidateCode(r.Code); err != nil {
+		return err
+	}
+	if err := r.validateValidity(); err != nil {
+		return err
+	}
+	return validateQueryPolicy(r.Query)
+}
+
+// ValidateCode checks that code is 0 (for DefaultCode) or a redirect status code
+func ValidateCode(code int) error {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	}
+	return fmt.Errorf("invalid redirect code %v, allowed are 301, 302, 303, 307 and 308", code)
+}
+
+//HostSettings are the settings of a hostname, which apply to all its redirects
+type HostSettings struct {
+	Hostname      string //hostname of the redirector, can be a wildcard hostname or * for all hostnames
+	Query         string `json:",omitempty"` //query policy for redirects without own policy, empty for QueryDrop
+	Default       string `json:",omitempty"` //target for all URLs of the hostname without redirect, empty for none
+	DefaultCode   int    `json:",omitempty"` //HTTP status code of the default target, 0 for DefaultCode
+	IgnoreCase    bool   `json:",omitempty"` //match paths of exact URLs and prefix rules case-insensitive
+	TrailingSlash bool   `json:",omitempty"` //match exact URLs with and without trailing slash, e.g. /a and /a/
+
+	HTTPS                 bool `json:",omitempty"` //upgrade plain HTTP requests to HTTPS before redirects apply
+	HSTSMaxAge            int  `json:",omitempty"` //max-age of the Strict-Transport-Security header of HTTPS responses in seconds, 0 for no header
+	HSTSIncludeSubDomains bool `json:",omitempty"` //add includeSubDomains to the Strict-Transport-Security header
+	HSTSPreload           bool `json:",omitempty"` //add preload to the Strict-Transport-Security header
+}
+
+// Validate checks the hostname and all settings, schemes are the URL schemes allowed for the default target (see ValidateTarget).
+// Errors are a ValidationError.
+func (h HostSettings) Validate(schemes ...string) error {
+	return validationError(h.validate(schemes))
+}
+
+func (h HostSettings) validate(schemes []string) error {
+	if h.Hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+	if err := validateHostname(h.Hostname); err != nil {
+		return err
+	}
+	if err := ValidateCode(h.DefaultCode); err != nil {
+		return err
+	}
+	if h.DefaultCode != 0 && h.Default == "" {
+		return fmt.Errorf("a default code requires a default target")
+	}
+	if h.Default != "" {
+		if err := ValidateTarget(h.Default, schemes...); err != nil {
+			return err
+		}
+	}
+	if err := h.validateHSTS(); err != nil {
+		return err
+	}
+	return validateQueryPolicy(h.Query)
+}
+
+// defaultRedirect returns the redirect to the default target, ok is false if the hostname has no default target
+func (h HostSettings) defaultRedirect() (redirect Redirect, ok bool) {
+	if h.Default == "" {
+		return Redirect{}, false
+	}
+	return Redirect{Hostname: h.Hostname, Target: h.Default, Code: h.DefaultCode, Query: h.Query}, true
+}
+
+// empty returns true if no setting differs from the default
+func (h HostSettings) empty() bool {
+	return h == HostSettings{Hostname: h.Hostname}
 }
 
 // Redirector interface
 type Redirector interface {
-	GetAllRedirects() []Redirect                                      // Get all redirects known to redirects
-	GetRedirectsForHost(hostname string) []Redirect                   // Get all redirects for a specific hostname
-	GetRedirect(hostname string, url string) []Redirect               // Get redirect for a specific hostname & url (should be only one)
-	AddRedirect(redirect Redirect) error                              // Add a new redirect for a hostname & url
-	RemoveRedirect(redirect Redirect)                                 // Remove a redirect specific to hostname & url
-	RemoveAllRedirectsForHost(redirect Redirect)                      // Remove all redirects for a hostname
-	GetTarget(hostname string, url string) (target string, err error) // Return the redirect target for the hostname & url
+	GetAllRedirects() []Redirect                             // Get all redirects known to redirects
+	GetRedirectsForHost(hostname string) []Redirect          // Get all redirects for a specific hostname
+	GetRedirect(hostname string, url string) []Redirect      // Get redirect for a specific hostname & url (should be only one)
+	AddRedirect(redirect Redirect) error                     // Add a new redirect for a hostname & url
+	AddRedirectIfAbsent(redirect Redirect) error             // Add a new redirect for a hostname & url, an ExistsError if there already is one
+	RemoveRedirect(redirect Redirect)                        // Remove a redirect specific to hostname & url
+	RemoveAllRedirectsForHost(redirect Redirect)             // Remove all redirects for a hostname
+	GetTarget(hostname string, url string) (Redirect, error) // Return the redirect for the hostname & url (path?query), its Target is the forwarding address
+	GetAllHostSettings() []HostSettings                      // Get the settings of all hostnames which have settings
+	GetHostSettings(hostname string) HostSettings            // Get the settings of a hostname (default settings if it has none)
+	SetHostSettings(settings HostSettings) error             // Set the settings of a hostname, default settings remove them
 }
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTargetSchemes are the URL schemes allowed for targets if no other schemes are set (see MapRedirect.SetTargetSchemes).
+// Targets can also be paths starting with / (on the requested hostname).
+var DefaultTargetSchemes = []string{"http", "https"}
+
+// maxHops is the maximum number of redirects followed when checking for loops, browsers give up after about 20 redirects
+const maxHops = 20
+
+// ValidateTarget checks that target is an absolute URL with one of schemes (with hostname for http and https) or a path.
+// Without schemes DefaultTargetSchemes are allowed. Protocol-relative URLs (//example.com/) are not paths, they leave the hostname.
+func ValidateTarget(target string, schemes ...string) error {
+	if len(schemes) == 0 {
+		schemes = DefaultTargetSchemes
+	}
+
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %v: %v", target, err)
+	}
+	if u.Scheme == "" {
+		// browsers also treat /\ as //
+		if !strings.HasPrefix(target, "/") || u.Host != "" || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+			return fmt.Errorf("invalid target %v, an absolute URL (https://example.com/) or a path starting with a single / is required", target)
+		}
+		return nil
+	}
+
+	allowed := false
+	for _, scheme := range schemes {
+		allowed = allowed || strings.EqualFold(u.Scheme, scheme)
+	}
+	if !allowed {
+		return fmt.Errorf("invalid target %v, scheme %v is not allowed (allowed are %v)", target, u.Scheme, strings.Join(schemes, ", "))
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return fmt.Errorf("invalid target %v, hostname is missing", target)
+	}
+	return nil
+}
+
+// validateTargets checks the target and all scheduled targets of the redirect (see ValidateTarget),
+// the targets of a prefix rule need a path to append the rest of the path to (e.g. no mailto: URL)
+func (r Redirect) validateTargets(schemes []string) error {
+	prefix := strings.HasSuffix(r.URL, prefixWildcard) && !strings.HasPrefix(r.URL, regexpMarker)
+	targets := []string{r.Target}
+	for _, change := range r.Schedule {
+		targets = append(targets, change.Target)
+	}
+	for _, target := range targets {
+		if err := ValidateTarget(target, schemes...); err != nil {
+			return err
+		}
+		if u, err := neturl.Parse(target); prefix && err == nil && u.Opaque != "" {
+			return fmt.Errorf("invalid target %v, a prefix rule needs a target with a path", target)
+		}
+	}
+	return nil
+}
+
+// LoopError is returned when a redirect or host settings would lead into a redirect loop with the other redirects (see checkLoop)
+type LoopError struct {
+	Hostname string // hostname of the redirect starting the loop
+	Reason   string // description of the loop, e.g. the followed redirects
+}
+
+func (e *LoopError) Error() string {
+	return e.Reason
+}
+
+// request is a request followed when checking for loops
+type request struct {
+	hostname string
+	url      string // normalized path, optionally followed by ?query
+}
+
+func (r request) String() string {
+	return r.hostname + r.url
+}
+
+// nextRequest returns the request a redirect of hostname to target leads to, ok is false if it leaves the server (e.g. mailto:)
+func nextRequest(hostname, target string) (next request, ok bool) {
+	u, err := neturl.Parse(target)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") || (u.Scheme != "" && u.Host == "") {
+		return request{}, false
+	}
+	if u.Host != "" {
+		hostname = u.Host
+	}
+
+	url := u.EscapedPath()
+	if url == "" {
+		url = "/"
+	}
+	if u.RawQuery != "" {
+		url += "?" + u.RawQuery
+	}
+	return request{NormalizeHost(hostname), NormalizeURL(url)}, true
+}
+
+// target returns the redirect for hostname and url (both normalized) like MapRedirect.GetTarget and the hostname it was found for.
+// A rule expanding to an invalid target stops the lookup with a TargetError, other hostnames are not tried.
+func (hosts hostMap) target(hostname, url string, now time.Time) (redirect Redirect, candidate string, ok bool, err error) {
+	for _, candidate := range hostCandidates(hostname) {
+		if redirect, ok, err := hosts[candidate].lookup(url, now); ok {
+			return redirect, candidate, true, err
+		}
+	}
+	return Redirect{}, "", false, nil
+}
+
+// checkLoop follows the redirects of hosts from redirect on and returns a LoopError if they lead into a loop
+// (a request is repeated or more than maxHops redirects follow).
+// All targets of redirect (including scheduled ones) are followed, further redirects with their target at now.
+// Targets of regular expression rules with submatches depend on the request and are not followed.
+// Other hostnames only matched by AnyHost are not followed, they are probably not served by this server.
+func (hosts hostMap) checkLoop(redirect Redirect, now time.Time) error {
+	rule := strings.HasPrefix(redirect.URL, regexpMarker)
+	exact := redirect.URL != "" && !rule && !strings.HasSuffix(redirect.URL, prefixWildcard)
+
+	targets := []string{redirect.Target}
+	for _, change := range redirect.Schedule {
+		targets = append(targets, change.Target)
+	}
+
+	for _, target := range targets {
+		if rule && strings.Contains(target, "$") {
+			continue
+		}
+
+		from := request{redirect.Hostname, redirect.URL}
+		if redirect.URL == "" {
+			from.url = " (default target)"
+		}
+		chain := []string{from.String()}
+		seen := make(map[request]bool)
+		if exact {
+			seen[from] = true
+		}
+
+		previous := redirect.Hostname
+		next, ok := nextRequest(redirect.Hostname, target)
+		for hops := 1; ok; hops++ {
+			found, candidate, exists, err := hosts.target(next.hostname, next.url, now)
+			if !exists || err != nil || (candidate == AnyHost && next.hostname != previous) {
+				break
+			}
+
+			chain = append(chain, next.String())
+			if seen[next] {
+				return &LoopError{redirect.Hostname, "redirect loop: " + strings.Join(chain, " -> ")}
+			}
+			if hops > maxHops {
+				return &LoopError{redirect.Hostname, fmt.Sprintf("redirect loop: more than %v redirects: %v -> ...", maxHops, strings.Join(chain[:4], " -> "))}
+			}
+			seen[next] = true
+			previous = next.hostname
+			next, ok = nextRequest(next.hostname, found.Target)
+		}
+	}
+	return nil
+}
+
+// checkHostLoops checks the redirects and the default target of hostname for loops (see checkLoop)
+func (hosts hostMap) checkHostLoops(hostname string, now time.Time) error {
+	redirects := hosts[hostname]
+	if redirects == nil {
+		return nil
+	}
+	if redirect, ok := redirects.settings.defaultRedirect(); ok {
+		if err := hosts.checkLoop(redirect, now); err != nil {
+			return err
+		}
+	}
+	for _, redirect := range redirects.urls {
+		if err := hosts.checkLoop(redirect, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLoops checks the redirects and default targets of all hostnames for loops (see checkLoop)
+func (hosts hostMap) checkLoops(now time.Time) error {
+	for hostname := range hosts {
+		if err := hosts.checkHostLoops(hostname, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package storage
+
+import "testing"
+
+func TestValidateTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		schemes []string
+		valid   bool
+	}{
+		{"https://example.com/", nil, true},
+		{"HTTP://example.com/a?b=c", nil, true},
+		{"/path", nil, true},
+		{"/", nil, true},
+		{"//evil.com/x", nil, false},
+		{"//evil.com", nil, false},
+		{"///evil.com", nil, false},
+		{"/\\evil.com", nil, false},
+		{"path", nil, false},
+		{"http://", nil, false},
+		{"javascript:alert(1)", nil, false},
+		{"mailto:someone@example.com", nil, false},
+		{"mailto:someone@example.com", []string{"http", "https", "mailto"}, true},
+		{"http://example.com/", []string{"https"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			err := ValidateTarget(tt.target, tt.schemes...)
+			if tt.valid && err != nil {
+				t.Errorf("%v is rejected with schemes %v: %v", tt.target, tt.schemes, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("%v is accepted with schemes %v", tt.target, tt.schemes)
+			}
+		})
+	}
+}
+
+func TestMapRedirectTargetSchemes(t *testing.T) {
+	red := NewMapRedirect(quietLogger())
+	mailto := Redirect{Hostname: "example.com", URL: "/mail", Target: "mailto:someone@example.com"}
+	if err := red.AddRedirect(mailto); err == nil {
+		t.Errorf("mailto target is accepted without the scheme")
+	}
+
+	red.SetTargetSchemes([]string{"http", "https", "mailto"})
+	if err := red.AddRedirect(mailto); err != nil {
+		t.Errorf("mailto target is rejected with the scheme: %v", err)
+	}
+	if err := red.SetHostSettings(HostSettings{Hostname: "example.com", Default: "mailto:someone@example.com"}); err != nil {
+		t.Errorf("mailto default target is rejected with the scheme: %v", err)
+	}
+
+	// the schemes are a setting of each MapRedirect
+	if err := NewMapRedirect(quietLogger()).AddRedirect(mailto); err == nil {
+		t.Errorf("mailto target is accepted by another MapRedirect")
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// Violation is a problem of a redirect or host settings of a save file (see ValidateFile)
+type Violation struct {
+	Hostname string // hostname of the redirect or settings
+	URL      string // URL of the redirect, empty for host settings
+	Reason   string // description of the problem
+}
+
+// ValidateFile checks all redirects and host settings of a save file and returns all problems sorted by hostname and URL:
+// invalid redirects and settings (see Redirect.Validate and HostSettings.Validate), conflicts within a hostname and redirect loops.
+// Unlike DecodeFile it does not stop at the first problem, so it can report the problems of files the server refuses to load.
+// err is only set if the file cannot be parsed at all. schemes are the URL schemes allowed for targets (see Redirect.Validate).
+func ValidateFile(b []byte, schemes ...string) ([]Violation, error) {
+	file, _, err := decodeFile(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []Violation
+	var redirects []Redirect
+	for _, redirect := range file.Redirects {
+		if err := redirect.Validate(schemes...); err != nil {
+			violations = append(violations, Violation{redirect.Hostname, redirect.URL, err.Error()})
+			continue
+		}
+		redirects = append(redirects, redirect)
+	}
+	var hostSettings []HostSettings
+	for _, s := range file.HostSettings {
+		if err := s.Validate(schemes...); err != nil {
+			violations = append(violations, Violation{s.Hostname, "", err.Error()})
+			continue
+		}
+		hostSettings = append(hostSettings, s)
+	}
+
+	settings, urls := groupByHost(redirects, hostSettings)
+	hosts := make(hostMap, len(settings))
+	for hostname, s := range settings {
+		if err := hosts.put(s, urls[hostname]); err != nil {
+			violations = append(violations, Violation{hostname, "", err.Error()})
+		}
+	}
+
+	now := time.Now()
+	for _, redirects := range hosts {
+		if redirect, ok := redirects.settings.defaultRedirect(); ok {
+			if err := hosts.checkLoop(redirect, now); err != nil {
+				violations = append(violations, Violation{redirect.Hostname, "", err.Error()})
+			}
+		}
+		for _, redirect := range redirects.urls {
+			if err := hosts.checkLoop(redirect, now); err != nil {
+				violations = append(violations, Violation{redirect.Hostname, redirect.URL, err.Error()})
+			}
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Hostname != violations[j].Hostname {
+			return violations[i].Hostname < violations[j].Hostname
+		}
+		return violations[i].URL < violations[j].URL
+	})
+	return violations, nil
+}